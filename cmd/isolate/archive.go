@@ -7,7 +7,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
 
+	"chromium.googlesource.com/infra/swarming/client-go/isolate"
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
 	"github.com/maruel/subcommands"
 )
 
@@ -45,7 +48,24 @@ func (c *archiveRun) Parse(a subcommands.Application, args []string) error {
 }
 
 func (c *archiveRun) main(a subcommands.Application, args []string) error {
-	return errors.New("TODO")
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	chTrees := make(chan isolate.Tree, 1)
+	chTrees <- isolate.Tree{Cwd: cwd, Opts: c.ArchiveOptions}
+	close(chTrees)
+	chIsolateHashes, chFileAssets, chIsoErrors := isolate.IsolateAsync(chTrees, isolateserver.GetHashAlgo(c.Namespace), nil)
+	api := c.createStorageApi()
+	chArchiveErrors := isolate.ArchiveAsync(chFileAssets, api)
+	if err := waitPipeline(chIsoErrors, chArchiveErrors); err != nil {
+		return err
+	}
+	for target, hash := range <-chIsolateHashes {
+		fmt.Fprintf(a.GetOut(), "%s %s\n", hash, target)
+	}
+	printDryRun(a.GetOut(), api)
+	return nil
 }
 
 func (c *archiveRun) Run(a subcommands.Application, args []string) int {
@@ -13,6 +13,7 @@ import (
 
 	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
 	"chromium.googlesource.com/infra/swarming/client-go/isolate"
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
 	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
@@ -40,6 +41,8 @@ isolate. Format of files is:
 		c.commonServerFlags.Init(&c.CommandRunBase)
 		c.Flags.StringVar(&c.dumpJson, "dump-json", "",
 			"Write isolated Digestes of archived trees to this file as JSON")
+		c.Flags.StringVar(&c.hashCache, "hash-cache", "",
+			"File to keep the digests of the files between runs, so unchanged files are not hashed again")
 		return &c
 	},
 }
@@ -48,7 +51,8 @@ type batchArchiveRun struct {
 	subcommands.CommandRunBase
 	commonFlags
 	commonServerFlags
-	dumpJson string
+	dumpJson  string
+	hashCache string
 }
 
 func (c *batchArchiveRun) Parse(a subcommands.Application, args []string) error {
@@ -171,38 +175,34 @@ func parseGenFiles(genJsonPaths []string) (<-chan isolate.Tree, <-chan error) {
 }
 
 func (c *batchArchiveRun) main(a subcommands.Application, args []string) error {
-	// Library interrupt is used for clean handling of Ctrl+C or in case of unrecoverable errors.
-	defer interrupt.Set()
 	// 3 step pipeline is connected using two channels:
 	// [Parsing Gen Files] => chTrees => [Isolate] => chFileAssets => [Archive] .
 	// The error channels are collected here.
-	chTrees, chGenErrors := parseGenFiles(args)
-	chIsolateHashes, chFileAssets, chIsoErrors := isolate.IsolateAsync(chTrees)
-	chArchiveErrors := isolate.ArchiveAsync(chFileAssets, c.serverURL, c.namespace)
-	select {
-	case cerr := <-chGenErrors:
-		if cerr != nil {
-			return cerr
-		}
-	case ierr := <-chIsoErrors:
-		if ierr != nil {
-			return ierr
+	algo := isolateserver.GetHashAlgo(c.Namespace)
+	cache := isolate.NewHashCache(algo)
+	if c.hashCache != "" {
+		var err error
+		if cache, err = isolate.LoadHashCache(c.hashCache, algo); err != nil {
+			return err
 		}
-	case uerr := <-chArchiveErrors:
-		if uerr != nil {
-			return uerr
-		} else {
-			// Success, no uploading error.
-			isolatedHashes := <-chIsolateHashes
-			if c.dumpJson != "" {
-				return common.WriteJSONFile(c.dumpJson, isolatedHashes)
-			}
-			return nil
+	}
+	chTrees, chGenErrors := parseGenFiles(args)
+	chIsolateHashes, chFileAssets, chIsoErrors := isolate.IsolateAsync(chTrees, algo, cache)
+	api := c.createStorageApi()
+	chArchiveErrors := isolate.ArchiveAsync(chFileAssets, api)
+	if err := waitPipeline(chGenErrors, chIsoErrors, chArchiveErrors); err != nil {
+		return err
+	}
+	isolatedHashes := <-chIsolateHashes
+	printDryRun(a.GetOut(), api)
+	if c.hashCache != "" {
+		if err := cache.Save(c.hashCache); err != nil {
+			return err
 		}
-	case <-interrupt.Channel:
-		return errors.New("interrupted")
 	}
-	// Unreachable code.
+	if c.dumpJson != "" {
+		return common.WriteJSONFile(c.dumpJson, isolatedHashes)
+	}
 	return nil
 }
 
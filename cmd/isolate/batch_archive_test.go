@@ -5,12 +5,62 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+	"chromium.googlesource.com/infra/swarming/client-go/isolate"
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+	"github.com/maruel/subcommands"
 	"github.com/stretchr/testify/assert"
 )
 
+// testApp captures the output of the commands.
+type testApp struct {
+	subcommands.DefaultApplication
+	out bytes.Buffer
+	err bytes.Buffer
+}
+
+func (t *testApp) GetOut() io.Writer { return &t.out }
+func (t *testApp) GetErr() io.Writer { return &t.err }
+
+// runCommand parses args with the flags of cmd and runs it.
+func runCommand(t *testing.T, cmd *subcommands.Command, args ...string) (*testApp, int) {
+	a := &testApp{DefaultApplication: subcommands.DefaultApplication{Name: "isolate"}}
+	r := cmd.CommandRun()
+	assert.NoError(t, r.GetFlags().Parse(args))
+	return a, r.Run(a, r.GetFlags().Args())
+}
+
+// writeGenTree writes a tree with foo.isolate in dir and the
+// foo.isolated.gen.json file describing it, and returns the path of the
+// latter.
+func writeGenTree(t *testing.T, dir string) string {
+	files := map[string]string{
+		"foo.isolate": "{'variables': {'command': ['foo'], 'files': ['foo.txt']}}",
+		"foo.txt":     "foo",
+	}
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	genJson := filepath.Join(dir, "foo.isolated.gen.json")
+	assert.NoError(t, common.WriteJSONFile(genJson, map[string]interface{}{
+		"version": isolate.ISOLATED_GEN_JSON_VERSION,
+		"dir":     dir,
+		"args":    []string{"--isolate", "foo.isolate", "--isolated", "foo.isolated"},
+	}))
+	return genJson
+}
+
 func TestConvertPyToGoArchiveCMDArgs(t *testing.T) {
 	data := []struct {
 		input    []string
@@ -62,3 +112,97 @@ func TestArchiveCMDParsing(t *testing.T) {
 	assert.Equal(t, opts.ConfigVariables, map[string]string{"OS": "linux"})
 	assert.Equal(t, opts.ExtraVariables, map[string]string{"version_full": "42.0.2284.0"})
 }
+
+func TestPrintDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	api := isolateserver.NewDryLoggingStorageApi("https://example.com", "default")
+	for _, name := range []string{"b", "a"} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(name+name), 0600))
+		item := &isolateserver.FileItem{Item: isolateserver.Item{Digest: name, Size: 2}, Path: path}
+		assert.NoError(t, <-api.Push(nil, item, isolateserver.PushState{}))
+	}
+	out := &bytes.Buffer{}
+	printDryRun(out, api)
+	assert.Equal(t, fmt.Sprintf("a          2 %s\nb          2 %s\n", filepath.Join(dir, "a"), filepath.Join(dir, "b"))+
+		"Would upload 2 items: 4 bytes, 4 bytes sent to https://example.com (default)\n", out.String())
+
+	out.Reset()
+	printDryRun(out, isolateserver.GetStorageApi("https://example.com", "default"))
+	assert.Equal(t, "", out.String())
+}
+
+func TestBatchArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	genJson := writeGenTree(t, dir)
+	store := filepath.Join(dir, "store")
+	dump := filepath.Join(dir, "dump.json")
+
+	a, ret := runCommand(t, cmdBatchArchive, "-local-store", store, "-namespace", "default", "-dump-json", dump, genJson)
+	assert.Equal(t, 0, ret, a.err.String())
+	hashes := map[string]IsolateHash{}
+	assert.NoError(t, common.ReadJSONFile(dump, &hashes))
+	assert.Equal(t, 1, len(hashes))
+	// The whole tree can be fetched back from the store.
+	s := isolateserver.NewStorage(isolateserver.LocalStoreURL(store), "default")
+	out := filepath.Join(dir, "out")
+	_, err = isolateserver.FetchIsolated(nil, s, hashes["foo"], out)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(out, "foo.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(content))
+
+	// With -dry-run, the items are listed instead of being stored.
+	dryStore := filepath.Join(dir, "dry")
+	a, ret = runCommand(t, cmdBatchArchive, "-local-store", dryStore, "-namespace", "default", "-dry-run", genJson)
+	assert.Equal(t, 0, ret, a.err.String())
+	assert.Contains(t, a.out.String(), filepath.Join(dir, "foo.txt"))
+	assert.Contains(t, a.out.String(), "Would upload 2 items: ")
+	_, err = os.Stat(dryStore)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBatchArchiveHashCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	genJson := writeGenTree(t, dir)
+	hashCache := filepath.Join(dir, "hashes.json")
+
+	a, ret := runCommand(t, cmdBatchArchive, "-local-store", filepath.Join(dir, "store"), "-namespace", "default", "-hash-cache", hashCache, genJson)
+	assert.Equal(t, 0, ret, a.err.String())
+	_, err = os.Stat(hashCache)
+	assert.NoError(t, err)
+	_, err = isolate.LoadHashCache(hashCache, "sha-1")
+	assert.NoError(t, err)
+	// The saved cache is loaded by the next run.
+	a, ret = runCommand(t, cmdBatchArchive, "-local-store", filepath.Join(dir, "store"), "-namespace", "default", "-hash-cache", hashCache, genJson)
+	assert.Equal(t, 0, ret, a.err.String())
+}
+
+func TestBatchArchiveDiskServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	genJson := writeGenTree(t, dir)
+	server, err := isolateserver.NewDiskServer(filepath.Join(dir, "server"), []string{"default-gzip"})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	dump := filepath.Join(dir, "dump.json")
+
+	a, ret := runCommand(t, cmdBatchArchive, "-I", ts.URL, "-namespace", "default-gzip", "-dump-json", dump, genJson)
+	assert.Equal(t, 0, ret, a.err.String())
+	hashes := map[string]IsolateHash{}
+	assert.NoError(t, common.ReadJSONFile(dump, &hashes))
+	out := filepath.Join(dir, "out")
+	_, err = isolateserver.FetchIsolated(nil, isolateserver.NewStorage(ts.URL, "default-gzip"), hashes["foo"], out)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(out, "foo.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(content))
+}
@@ -6,9 +6,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"sort"
 
 	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
 	"chromium.googlesource.com/infra/swarming/client-go/isolate"
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -24,31 +28,80 @@ func (c *commonFlags) Init(b *subcommands.CommandRunBase) {
 }
 
 type commonServerFlags struct {
-	serverURL string
-	namespace string
+	isolateserver.ServerFlags
+	dryRun bool
 }
 
 func (c *commonServerFlags) Init(b *subcommands.CommandRunBase) {
-	b.Flags.StringVar(&c.serverURL, "isolate-server",
-		"https://isolateserver-dev.appspot.com/", "")
-	b.Flags.StringVar(&c.serverURL, "I",
-		"https://isolateserver-dev.appspot.com/", "")
-	b.Flags.StringVar(&c.namespace, "namespace", "testing", "")
+	c.ServerFlags.Init(&b.Flags, "testing")
+	b.Flags.BoolVar(&c.dryRun, "dry-run", false,
+		"Print what would be uploaded instead of uploading it")
 }
 
 func (c *commonServerFlags) Parse() error {
-	if c.serverURL == "" {
-		return errors.New("-isolate-server must be specified")
+	return c.ServerFlags.Parse()
+}
+
+// createStorageApi returns the StorageApi to upload to, which doesn't upload
+// anything with -dry-run.
+func (c *commonServerFlags) createStorageApi() isolateserver.StorageApi {
+	if c.dryRun {
+		return isolateserver.NewDryLoggingStorageApi(c.ServerURL, c.Namespace)
 	}
-	if s, err := common.URLToHTTPS(c.serverURL); err != nil {
-		return err
-	} else {
-		c.serverURL = s
+	return isolateserver.GetStorageApi(c.ServerURL, c.Namespace)
+}
+
+// printDryRun prints the items that would have been uploaded to api and the
+// byte totals, if api is a DryLoggingStorageApi.
+func printDryRun(w io.Writer, api isolateserver.StorageApi) {
+	dry, ok := api.(*isolateserver.DryLoggingStorageApi)
+	if !ok {
+		return
 	}
-	if c.namespace == "" {
-		return errors.New("-namespace must be specified.")
+	pushes := dry.Pushes()
+	sort.Sort(dryPushesByPath(pushes))
+	var size, sent int64
+	for _, p := range pushes {
+		fmt.Fprintf(w, "%s %10d %s\n", p.Digest, p.Size, p.Path)
+		size += p.Size
+		sent += p.Sent
 	}
-	return nil
+	fmt.Fprintf(w, "Would upload %d items: %d bytes, %d bytes sent to %s (%s)\n",
+		len(pushes), size, sent, dry.Location(), dry.Namespace())
+}
+
+type dryPushesByPath []isolateserver.DryPush
+
+func (d dryPushesByPath) Len() int      { return len(d) }
+func (d dryPushesByPath) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dryPushesByPath) Less(i, j int) bool {
+	if d[i].Path != d[j].Path {
+		return d[i].Path < d[j].Path
+	}
+	return d[i].Digest < d[j].Digest
+}
+
+// waitPipeline waits for all the steps of a pipeline to complete and returns
+// the first error. The library interrupt is set on the first error so the
+// other steps don't block on it, or if the pipeline was interrupted.
+func waitPipeline(chErrors ...<-chan error) error {
+	chAll := make(chan error, len(chErrors))
+	for _, ch := range chErrors {
+		go func(ch <-chan error) {
+			chAll <- <-ch
+		}(ch)
+	}
+	var first error
+	for range chErrors {
+		if err := <-chAll; err != nil && first == nil {
+			first = err
+			interrupt.Set()
+		}
+	}
+	if first == nil && interrupt.IsSet() {
+		first = errors.New("interrupted")
+	}
+	return first
 }
 
 type isolateFlags struct {
@@ -70,6 +123,13 @@ func (c *isolateFlags) Init(b *subcommands.CommandRunBase) {
 	b.Flags.Var(&c.blacklistCollector, "blacklist",
 		"List of regexp to use as blacklist filter when uploading directories")
 
+	b.Flags.IntVar(&c.ArchiveOptions.MaxConcurrentIO, "max-concurrent-io", 0,
+		"Maximum number of files read concurrently when hashing, 0 means one per CPU")
+	b.Flags.BoolVar(&c.ArchiveOptions.FollowSymlinks, "follow-symlinks", false,
+		"Map the target of the symlinks instead of the symlinks themselves")
+	b.Flags.BoolVar(&c.ArchiveOptions.AllowBrokenSymlinks, "allow-broken-symlinks", false,
+		"Allow dangling symlinks and symlinks pointing outside of the root directory")
+
 	c.configVarsCollector.SetAsFlag(&b.Flags, &c.ConfigVariables, "config-variable",
 		`Config variables are used to determine which
 		conditions should be matched when loading a .isolate
@@ -0,0 +1,83 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdDownload = &subcommands.Command{
+	UsageLine: "download options...",
+	ShortDesc: "downloads the tree of an .isolated file.",
+	LongDesc: `Fetches the .isolated file, the .isolated files it includes and all the files
+they list from the isolate server, and recreates the tree in -target.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := downloadRun{}
+		b := &c.CommandRunBase
+		c.ServerFlags.Init(&b.Flags, "default-gzip")
+		b.Flags.StringVar(&c.isolated, "isolated", "", "Hash of the .isolated file to download")
+		b.Flags.StringVar(&c.isolated, "s", "", "")
+		b.Flags.StringVar(&c.target, "target", "", "Directory to download the tree into")
+		b.Flags.StringVar(&c.target, "t", "", "")
+		return &c
+	},
+}
+
+type downloadRun struct {
+	subcommands.CommandRunBase
+	isolateserver.ServerFlags
+	isolated string
+	target   string
+}
+
+func (c *downloadRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.ServerFlags.Parse(); err != nil {
+		return err
+	}
+	if !isolateserver.IsValidHash(c.isolated, isolateserver.GetHashAlgo(c.Namespace)) {
+		return fmt.Errorf("-isolated must be a valid %s hash", isolateserver.GetHashAlgo(c.Namespace))
+	}
+	if c.target == "" {
+		return errors.New("-target must be specified")
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *downloadRun) main(a subcommands.Application, args []string) error {
+	s := isolateserver.NewStorage(c.ServerURL, c.Namespace)
+	isolated, err := isolateserver.FetchIsolated(interrupt.Channel, s, IsolateHash(c.isolated), c.target)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Downloaded %d files in %s\n", len(isolated.Files), c.target)
+	if len(isolated.Command) != 0 {
+		fmt.Fprintf(a.GetOut(), "To run this test, run from %s:\n  %s\n",
+			filepath.Join(c.target, isolated.RelativeCwd), strings.Join(isolated.Command, " "))
+	}
+	return nil
+}
+
+func (c *downloadRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
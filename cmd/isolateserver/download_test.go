@@ -0,0 +1,68 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+	"github.com/maruel/subcommands"
+	"github.com/stretchr/testify/assert"
+)
+
+// testApp captures the output of the commands.
+type testApp struct {
+	subcommands.DefaultApplication
+	out bytes.Buffer
+	err bytes.Buffer
+}
+
+func (t *testApp) GetOut() io.Writer { return &t.out }
+func (t *testApp) GetErr() io.Writer { return &t.err }
+
+func TestDownloadDiskServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolateserver")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	server, err := isolateserver.NewDiskServer(filepath.Join(dir, "server"), []string{"default-gzip"})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// Upload a tree with a single file.
+	content, err := isolateserver.NewBufferItem([]byte("foo"), "sha-1", false)
+	assert.NoError(t, err)
+	size := content.Size
+	isolated := isolateserver.NewIsolated("sha-1")
+	isolated.Command = []string{"foo"}
+	isolated.Files["foo.txt"] = isolateserver.IsolatedFile{Digest: content.Digest, Size: &size}
+	data, err := isolated.Marshal()
+	assert.NoError(t, err)
+	item, err := isolateserver.NewBufferItem(data, "sha-1", true)
+	assert.NoError(t, err)
+	chItems := make(chan isolateserver.UploadItem, 2)
+	chItems <- content
+	chItems <- item
+	close(chItems)
+	s := isolateserver.NewStorage(ts.URL, "default-gzip")
+	_, err = s.Upload(nil, chItems)
+	assert.NoError(t, err)
+
+	a := &testApp{DefaultApplication: subcommands.DefaultApplication{Name: "isolateserver"}}
+	r := cmdDownload.CommandRun()
+	out := filepath.Join(dir, "out")
+	assert.NoError(t, r.GetFlags().Parse([]string{"-I", ts.URL, "-isolated", item.Digest, "-target", out}))
+	assert.Equal(t, 0, r.Run(a, r.GetFlags().Args()), a.err.String())
+	assert.Contains(t, a.out.String(), "Downloaded 1 files in "+out)
+	b, err := ioutil.ReadFile(filepath.Join(out, "foo.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(b))
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdServe = &subcommands.Command{
+	UsageLine: "serve options...",
+	ShortDesc: "runs an isolate server storing the items on the local disk.",
+	LongDesc: `Implements the server side of the isolate protocol. The items are stored in the
+-root directory, which can also be used directly with a file:// server URL.
+
+The server uses plain HTTP, which the clients only accept on the loopback
+interface, e.g. -isolate-server http://localhost:8080.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := serveRun{}
+		b := &c.CommandRunBase
+		b.Flags.StringVar(&c.http, "http", "localhost:8080", "Address to listen on")
+		b.Flags.StringVar(&c.root, "root", "", "Directory to store the items in")
+		c.namespacesCollector.Values = &c.namespaces
+		b.Flags.Var(&c.namespacesCollector, "namespace",
+			"Namespace to serve, can be repeated, default: default-gzip")
+		return &c
+	},
+}
+
+type serveRun struct {
+	subcommands.CommandRunBase
+	http                string
+	root                string
+	namespaces          []string
+	namespacesCollector common.StringsCollect
+}
+
+func (c *serveRun) Parse(a subcommands.Application, args []string) error {
+	if c.root == "" {
+		return errors.New("-root must be specified")
+	}
+	if len(c.namespaces) == 0 {
+		c.namespaces = []string{"default-gzip"}
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *serveRun) main(a subcommands.Application, args []string) error {
+	server, err := isolateserver.NewDiskServer(c.root, c.namespaces)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", c.http)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-interrupt.Channel
+		l.Close()
+	}()
+	log.Printf("serving %v from %s on http://%s", c.namespaces, c.root, l.Addr())
+	err = http.Serve(l, server)
+	if interrupt.IsSet() {
+		return nil
+	}
+	return err
+}
+
+func (c *serveRun) Run(a subcommands.Application, args []string) int {
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -103,9 +103,29 @@ func FixNativePathCase(root, inpath string) (string, error) {
 	return nativeCasePath, nil
 }
 
+// PosixpathJoin joins path elements with '/' like posixpath.join, keeping the
+// trailing '/' of the last element which denotes a directory.
 func PosixpathJoin(a ...string) string {
 	//TODO(tandrii): re-use a package for this?
-	return strings.Replace(filepath.Join(a...), string(os.PathSeparator), "/", 0)
+	out := filepath.ToSlash(filepath.Join(a...))
+	if len(a) > 0 && strings.HasSuffix(a[len(a)-1], "/") && !strings.HasSuffix(out, "/") {
+		out += "/"
+	}
+	return out
+}
+
+// PathStartsWith returns true if path is prefix or is inside prefix. Both must
+// be absolute paths.
+func PathStartsWith(prefix, path string) bool {
+	prefix = filepath.Clean(prefix)
+	path = filepath.Clean(path)
+	if prefix == path {
+		return true
+	}
+	if !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		prefix += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, prefix)
 }
 
 func GetFileNameWithoutExtension(path string) string {
@@ -0,0 +1,193 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
+)
+
+const HASH_CACHE_VERSION = "1.0"
+
+// HashCache caches the digests of files, keyed by their device, inode, size
+// and modification time, so a file shared by several trees is hashed only
+// once.
+//
+// It is safe for concurrent use. It can be saved to a file and loaded back so
+// unchanged files are not hashed again on the next run.
+type HashCache struct {
+	algo string
+
+	lock sync.Mutex
+	// entries are the digests used or calculated in this run.
+	entries map[hashCacheKey]*hashCacheEntry
+	// loaded are the digests loaded from the cache file not used yet.
+	loaded map[hashCacheKey]string
+}
+
+type hashCacheKey struct {
+	Dev   uint64 `json:"d"`
+	Inode uint64 `json:"i"`
+	Size  int64  `json:"s"`
+	Mtime int64  `json:"t"`
+}
+
+type hashCacheEntry struct {
+	// done is closed once digest or err is set.
+	done   chan struct{}
+	digest string
+	err    error
+}
+
+// hashCacheFile is the format of the file written by HashCache.Save.
+type hashCacheFile struct {
+	Algo    string            `json:"algo"`
+	Entries []hashCacheDigest `json:"entries"`
+	Version string            `json:"version"`
+}
+
+type hashCacheDigest struct {
+	hashCacheKey
+	Digest string `json:"h"`
+}
+
+// NewHashCache returns an empty HashCache for the hashing algorithm algo.
+func NewHashCache(algo string) *HashCache {
+	return &HashCache{
+		algo:    algo,
+		entries: map[hashCacheKey]*hashCacheEntry{},
+		loaded:  map[hashCacheKey]string{},
+	}
+}
+
+// LoadHashCache loads the HashCache saved in cacheFile.
+//
+// A missing file, or a file using a different version or hashing algorithm,
+// results in an empty cache.
+func LoadHashCache(cacheFile, algo string) (*HashCache, error) {
+	c := NewHashCache(algo)
+	if _, err := os.Stat(cacheFile); os.IsNotExist(err) {
+		return c, nil
+	}
+	data := hashCacheFile{}
+	if err := common.ReadJSONFile(cacheFile, &data); err != nil {
+		return nil, err
+	}
+	if data.Version != HASH_CACHE_VERSION || data.Algo != algo {
+		log.Printf("warning: %s uses version %s and %s instead of %s and %s. Discarding it",
+			cacheFile, data.Version, data.Algo, HASH_CACHE_VERSION, algo)
+		return c, nil
+	}
+	for _, e := range data.Entries {
+		c.loaded[e.hashCacheKey] = e.Digest
+	}
+	return c, nil
+}
+
+// Algo returns the hashing algorithm of the digests.
+func (c *HashCache) Algo() string {
+	return c.algo
+}
+
+// Save writes the digests used or calculated since the cache was loaded to
+// cacheFile. The entries of the files that were not seen are dropped so the
+// file doesn't grow forever.
+func (c *HashCache) Save(cacheFile string) error {
+	c.lock.Lock()
+	data := hashCacheFile{Algo: c.algo, Entries: []hashCacheDigest{}, Version: HASH_CACHE_VERSION}
+	for key, e := range c.entries {
+		select {
+		case <-e.done:
+			if e.err == nil {
+				data.Entries = append(data.Entries, hashCacheDigest{key, e.digest})
+			}
+		default:
+		}
+	}
+	c.lock.Unlock()
+	sort.Sort(hashCacheDigests(data.Entries))
+	return common.WriteJSONFile(cacheFile, &data)
+}
+
+// HashFile returns the digest of filePath, whose os.FileInfo is fi.
+//
+// The file is only hashed if no digest is cached for it. Concurrent calls for
+// the same file wait for a single hashing to complete.
+func (c *HashCache) HashFile(filePath string, fi os.FileInfo) (string, error) {
+	key, ok := newHashCacheKey(fi)
+	if !ok {
+		return HashFile(filePath, c.algo)
+	}
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &hashCacheEntry{done: make(chan struct{})}
+		c.entries[key] = e
+	}
+	digest, isLoaded := c.loaded[key]
+	delete(c.loaded, key)
+	c.lock.Unlock()
+	if ok {
+		<-e.done
+		return e.digest, e.err
+	}
+	if isLoaded {
+		e.digest = digest
+	} else if e.digest, e.err = HashFile(filePath, c.algo); e.err != nil {
+		// Let a later call try again.
+		c.lock.Lock()
+		delete(c.entries, key)
+		c.lock.Unlock()
+	}
+	close(e.done)
+	return e.digest, e.err
+}
+
+// add records digest for the file whose os.FileInfo is fi, unless a digest is
+// already known.
+func (c *HashCache) add(fi os.FileInfo, digest string) {
+	key, ok := newHashCacheKey(fi)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		e := &hashCacheEntry{done: make(chan struct{}), digest: digest}
+		close(e.done)
+		c.entries[key] = e
+		delete(c.loaded, key)
+	}
+}
+
+// newHashCacheKey returns the key identifying the content of a file. It
+// returns false if the device and inode are not available.
+func newHashCacheKey(fi os.FileInfo) (hashCacheKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return hashCacheKey{}, false
+	}
+	return hashCacheKey{uint64(st.Dev), uint64(st.Ino), fi.Size(), fi.ModTime().UnixNano()}, true
+}
+
+type hashCacheDigests []hashCacheDigest
+
+func (h hashCacheDigests) Len() int      { return len(h) }
+func (h hashCacheDigests) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hashCacheDigests) Less(i, j int) bool {
+	a, b := h[i].hashCacheKey, h[j].hashCacheKey
+	if a.Dev != b.Dev {
+		return a.Dev < b.Dev
+	}
+	if a.Inode != b.Inode {
+		return a.Inode < b.Inode
+	}
+	return a.Mtime < b.Mtime
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestHashCache(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{"foo": "foo", "bar": "bar"})
+	defer os.RemoveAll(dir)
+	foo := filepath.Join(dir, "foo")
+	fooInfo, err := os.Stat(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	barInfo, err := os.Stat(filepath.Join(dir, "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewHashCache("sha-1")
+	expected := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h, err := c.HashFile(foo, fooInfo); err != nil || h != expected {
+				t.Errorf("expected %s, got %s, %v", expected, h, err)
+			}
+		}()
+	}
+	wg.Wait()
+	c.add(barInfo, "cached")
+	cacheFile := filepath.Join(dir, "cache.json")
+	if err := c.Save(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// The saved digests are used without reading the files.
+	if c, err = LoadHashCache(cacheFile, "sha-1"); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := c.HashFile(filepath.Join(dir, "missing"), barInfo); err != nil || h != "cached" {
+		t.Errorf("expected the cached digest, got %s, %v", h, err)
+	}
+	// Only the entries used are saved again.
+	if err := c.Save(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = LoadHashCache(cacheFile, "sha-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.loaded) != 1 {
+		t.Errorf("expected 1 entry, got %v", c.loaded)
+	}
+
+	// A modified file is hashed again.
+	if err := ioutil.WriteFile(filepath.Join(dir, "bar"), []byte("barbar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if barInfo, err = os.Stat(filepath.Join(dir, "bar")); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := c.HashFile(filepath.Join(dir, "bar"), barInfo); err != nil || h == "cached" {
+		t.Errorf("expected the file to be hashed, got %s, %v", h, err)
+	}
+
+	// The cache is discarded for another algorithm.
+	if c, err = LoadHashCache(cacheFile, "sha-256"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.loaded) != 0 {
+		t.Errorf("expected no entry, got %v", c.loaded)
+	}
+	// A missing cache file is not an error.
+	if _, err = LoadHashCache(filepath.Join(dir, "missing"), "sha-1"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// condition is a parsed GYP-style expression as found in the 'conditions'
+// section of an .isolate file, e.g. 'OS=="linux" and (chromeos==1 or foo!="bar")'.
+//
+// The grammar is:
+//
+//	expr ::= expr ( "or" | "and" ) expr
+//	       | "not" expr
+//	       | "(" expr ")"
+//	       | identifier ( "==" | "!=" ) ( string | int )
+//	       | ( string | int ) ( "==" | "!=" ) identifier
+type condition interface {
+	// eval evaluates the condition. All the variables referenced by the
+	// condition must be in values.
+	eval(values map[string]string) bool
+	// collect adds the variables referenced by the condition and the values
+	// they are compared to in variables.
+	collect(variables map[string]map[string]bool)
+}
+
+type orCondition struct {
+	lhs, rhs condition
+}
+
+func (c *orCondition) eval(values map[string]string) bool {
+	return c.lhs.eval(values) || c.rhs.eval(values)
+}
+
+func (c *orCondition) collect(variables map[string]map[string]bool) {
+	c.lhs.collect(variables)
+	c.rhs.collect(variables)
+}
+
+type andCondition struct {
+	lhs, rhs condition
+}
+
+func (c *andCondition) eval(values map[string]string) bool {
+	return c.lhs.eval(values) && c.rhs.eval(values)
+}
+
+func (c *andCondition) collect(variables map[string]map[string]bool) {
+	c.lhs.collect(variables)
+	c.rhs.collect(variables)
+}
+
+type notCondition struct {
+	c condition
+}
+
+func (c *notCondition) eval(values map[string]string) bool {
+	return !c.c.eval(values)
+}
+
+func (c *notCondition) collect(variables map[string]map[string]bool) {
+	c.c.collect(variables)
+}
+
+// compareCondition compares a variable to a literal. Int literals are kept as
+// their decimal representation, since config variables are strings.
+type compareCondition struct {
+	variable string
+	value    string
+	equal    bool
+}
+
+func (c *compareCondition) eval(values map[string]string) bool {
+	return (values[c.variable] == c.value) == c.equal
+}
+
+func (c *compareCondition) collect(variables map[string]map[string]bool) {
+	if variables[c.variable] == nil {
+		variables[c.variable] = map[string]bool{}
+	}
+	variables[c.variable][c.value] = true
+}
+
+// conditionVariables returns the sorted names of the variables referenced by
+// c.
+func conditionVariables(c condition) []string {
+	variables := map[string]map[string]bool{}
+	c.collect(variables)
+	out := make([]string, 0, len(variables))
+	for name := range variables {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenString
+	tokenInt
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value string
+	// offset is the 0-based offset of the token in the expression, in runes.
+	offset int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// ConditionError is returned when a condition can't be parsed.
+type ConditionError struct {
+	// Expr is the condition as written in the .isolate file.
+	Expr string
+	// Column is the 1-based position in Expr where the error was found.
+	Column int
+	Msg    string
+}
+
+func (e *ConditionError) Error() string {
+	return fmt.Sprintf("column %d: %s in condition %q", e.Column, e.Msg, e.Expr)
+}
+
+type conditionParser struct {
+	expr   string
+	tokens []token
+	i      int
+}
+
+// parseCondition parses a condition expression.
+func parseCondition(expr string) (condition, error) {
+	p := conditionParser{expr: expr}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return c, nil
+}
+
+func (p *conditionParser) errorf(t token, format string, a ...interface{}) error {
+	return &ConditionError{p.expr, t.offset + 1, fmt.Sprintf(format, a...)}
+}
+
+func (p *conditionParser) tokenize() error {
+	runes := []rune(p.expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i++
+			continue
+		case r == '(' || r == ')':
+			i++
+		case r == '=' || r == '!':
+			if i+1 >= len(runes) || runes[i+1] != '=' {
+				return &ConditionError{p.expr, i + 1, fmt.Sprintf("unexpected '%c', expected '==' or '!='", r)}
+			}
+			i += 2
+			p.tokens = append(p.tokens, token{tokenOperator, string(runes[start:i]), "", start})
+			continue
+		case r == '\'' || r == '"':
+			value := []rune{}
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return &ConditionError{p.expr, start + 1, "unterminated string"}
+			}
+			i++
+			p.tokens = append(p.tokens, token{tokenString, string(runes[start:i]), string(value), start})
+			continue
+		case r >= '0' && r <= '9' || r == '-':
+			for i++; i < len(runes) && runes[i] >= '0' && runes[i] <= '9'; i++ {
+			}
+			text := string(runes[start:i])
+			v, err := strconv.Atoi(text)
+			if err != nil {
+				return &ConditionError{p.expr, start + 1, fmt.Sprintf("invalid number '%s'", text)}
+			}
+			p.tokens = append(p.tokens, token{tokenInt, text, strconv.Itoa(v), start})
+			continue
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			for i++; i < len(runes); i++ {
+				c := runes[i]
+				if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+					break
+				}
+			}
+			text := string(runes[start:i])
+			kind := tokenIdentifier
+			if text == "and" || text == "or" || text == "not" {
+				kind = tokenOperator
+			}
+			p.tokens = append(p.tokens, token{kind, text, text, start})
+			continue
+		default:
+			return &ConditionError{p.expr, i + 1, fmt.Sprintf("unexpected '%c'", r)}
+		}
+		p.tokens = append(p.tokens, token{tokenOperator, string(runes[start:i]), "", start})
+	}
+	p.tokens = append(p.tokens, token{tokenEOF, "", "", len(runes)})
+	return nil
+}
+
+func (p *conditionParser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *conditionParser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *conditionParser) isOperator(text string) bool {
+	t := p.peek()
+	return t.kind == tokenOperator && t.text == text
+}
+
+func (p *conditionParser) parseOr() (condition, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("or") {
+		p.next()
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &orCondition{lhs, rhs}
+	}
+	return lhs, nil
+}
+
+func (p *conditionParser) parseAnd() (condition, error) {
+	lhs, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("and") {
+		p.next()
+		rhs, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &andCondition{lhs, rhs}
+	}
+	return lhs, nil
+}
+
+func (p *conditionParser) parseNot() (condition, error) {
+	if p.isOperator("not") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notCondition{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *conditionParser) parsePrimary() (condition, error) {
+	if p.isOperator("(") {
+		open := p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOperator(")") {
+			return nil, p.errorf(open, "unbalanced '('")
+		}
+		p.next()
+		return c, nil
+	}
+	lhs := p.next()
+	if lhs.kind != tokenIdentifier && lhs.kind != tokenString && lhs.kind != tokenInt {
+		return nil, p.errorf(lhs, "unexpected %s, expected a comparison", lhs)
+	}
+	op := p.next()
+	if op.kind != tokenOperator || (op.text != "==" && op.text != "!=") {
+		return nil, p.errorf(op, "unexpected %s, expected '==' or '!='", op)
+	}
+	rhs := p.next()
+	if rhs.kind != tokenIdentifier && rhs.kind != tokenString && rhs.kind != tokenInt {
+		return nil, p.errorf(rhs, "unexpected %s, expected a string or an int", rhs)
+	}
+	variable, value := lhs, rhs
+	if lhs.kind != tokenIdentifier {
+		variable, value = rhs, lhs
+	}
+	if variable.kind != tokenIdentifier || value.kind == tokenIdentifier {
+		return nil, p.errorf(lhs, "a comparison must be between a variable and a string or an int")
+	}
+	return &compareCondition{variable.value, value.value, op.text == "=="}, nil
+}
+
+// matchConfigs returns the config names that match the condition c.
+//
+// configVariables is the sorted list of all the config variables of the
+// .isolate file and values the known values of each of them. Variables that
+// are not referenced by c are left unbound.
+func matchConfigs(c condition, configVariables []string, values map[string][]string) []ConfigName {
+	referenced := conditionVariables(c)
+	indexes := make([]int, len(referenced))
+	for i, name := range referenced {
+		indexes[i] = sort.SearchStrings(configVariables, name)
+	}
+	out := []ConfigName{}
+	current := map[string]string{}
+	var walk func(i int)
+	walk = func(i int) {
+		if i == len(referenced) {
+			if c.eval(current) {
+				key := make(ConfigName, len(configVariables))
+				for j, name := range referenced {
+					key[indexes[j]].Set(current[name])
+				}
+				out = append(out, key)
+			}
+			return
+		}
+		for _, v := range values[referenced[i]] {
+			current[referenced[i]] = v
+			walk(i + 1)
+		}
+	}
+	walk(0)
+	return out
+}
+
+// collectConfigValues returns the sorted config variables referenced by
+// conditions and, for each of them, the sorted values it is compared to.
+//
+// The values in extra are added for the variables that are referenced, so that
+// conditions like 'OS!="win"' also match values that are not listed in any
+// condition.
+func collectConfigValues(conditions []condition, extra map[string]string) ([]string, map[string][]string) {
+	variables := map[string]map[string]bool{}
+	for _, c := range conditions {
+		c.collect(variables)
+	}
+	names := make([]string, 0, len(variables))
+	values := map[string][]string{}
+	for name, set := range variables {
+		if v, ok := extra[name]; ok {
+			set[v] = true
+		}
+		names = append(names, name)
+		for v := range set {
+			values[name] = append(values[name], v)
+		}
+		sort.Strings(values[name])
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+// exprColumn returns the position of the column-th rune of a string literal
+// starting at pos, assuming the literal is on a single line.
+func exprColumn(pos textPos, column int, expr string) textPos {
+	if strings.ContainsRune(expr, '\n') {
+		return pos
+	}
+	// Skip the opening quote.
+	return textPos{pos.line, pos.column + column}
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConditionEval(t *testing.T) {
+	data := []struct {
+		expr     string
+		values   map[string]string
+		expected bool
+	}{
+		{`OS=="linux"`, map[string]string{"OS": "linux"}, true},
+		{`OS=="linux"`, map[string]string{"OS": "mac"}, false},
+		{`"linux"==OS`, map[string]string{"OS": "linux"}, true},
+		{`OS!="win"`, map[string]string{"OS": "linux"}, true},
+		{`not OS=="win"`, map[string]string{"OS": "win"}, false},
+		{`chromeos==1`, map[string]string{"chromeos": "1"}, true},
+		{`OS=="linux" and (chromeos==1 or foo=="bar")`,
+			map[string]string{"OS": "linux", "chromeos": "0", "foo": "bar"}, true},
+		{`OS=="linux" and (chromeos==1 or foo=="bar")`,
+			map[string]string{"OS": "linux", "chromeos": "0", "foo": "baz"}, false},
+		{`OS=="mac" or OS=="linux" and chromeos==1`,
+			map[string]string{"OS": "mac", "chromeos": "0"}, true},
+	}
+	for _, line := range data {
+		c, err := parseCondition(line.expr)
+		if err != nil {
+			t.Errorf("%s: %s", line.expr, err)
+			continue
+		}
+		if actual := c.eval(line.values); actual != line.expected {
+			t.Errorf("%s with %v: expected %v", line.expr, line.values, line.expected)
+		}
+	}
+}
+
+func TestConditionVariables(t *testing.T) {
+	c, err := parseCondition(`OS=="linux" and (chromeos==1 or not foo=="bar")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"OS", "chromeos", "foo"}
+	if actual := conditionVariables(c); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	data := []struct {
+		expr   string
+		column int
+	}{
+		{``, 1},
+		{`OS`, 3},
+		{`OS="linux"`, 3},
+		{`OS=="linux" and`, 16},
+		{`(OS=="linux"`, 1},
+		{`OS=="linux")`, 12},
+		{`OS==linux`, 1},
+		{`"a"=="b"`, 1},
+		{`OS=="linux`, 5},
+		{`OS<"linux"`, 3},
+	}
+	for _, line := range data {
+		_, err := parseCondition(line.expr)
+		cerr, ok := err.(*ConditionError)
+		if !ok {
+			t.Errorf("%s: expected a ConditionError, got %v", line.expr, err)
+		} else if cerr.Column != line.column {
+			t.Errorf("%s: expected column %d, got %s", line.expr, line.column, cerr)
+		}
+	}
+}
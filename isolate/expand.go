@@ -0,0 +1,215 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
+)
+
+// DEFAULT_BLACKLIST is the list of regexps of files that are never mapped
+// when expanding directories. They are matched against posix style paths
+// relative to the root directory.
+var DEFAULT_BLACKLIST = []string{
+	// Temporary vim or python files.
+	`^.+\.(?:pyc|swp)$`,
+	// .git or .svn directory.
+	`^(?:.+/|)\.(?:git|svn)$`,
+}
+
+// genBlacklist returns a function returning true if a relative posix path
+// matches any of the regexps.
+//
+// Like Python's re.match, regexps are anchored at the start of the path.
+func genBlacklist(regexes []string) (func(string) bool, error) {
+	compiled := make([]*regexp.Regexp, len(regexes))
+	for i, r := range regexes {
+		var err error
+		if compiled[i], err = regexp.Compile("^(?:" + r + ")"); err != nil {
+			return nil, fmt.Errorf("invalid blacklist regexp %q: %s", r, err)
+		}
+	}
+	return func(f string) bool {
+		for _, c := range compiled {
+			if c.MatchString(f) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// expandDirectoriesAndSymlinks expands the directories, applies the blacklist
+// and verifies files exist.
+//
+// infiles are posix style paths relative to indir; directories must have a
+// trailing '/'.
+//
+// Unless followSymlinks is set, symlinks are returned as is so they are mapped
+// as links, and they must point to an existing file inside indir. If
+// followSymlinks is set, they are resolved and their target, which must be
+// inside indir too, is mapped in their place; a link to one of its parent
+// directories is an error. allowBrokenSymlinks permits dangling links and links
+// pointing outside indir; when following links, dangling ones are skipped.
+func expandDirectoriesAndSymlinks(indir string, infiles []string, blacklist func(string) bool, followSymlinks, allowBrokenSymlinks bool) ([]string, error) {
+	e := &expander{
+		indir:               indir,
+		blacklist:           blacklist,
+		followSymlinks:      followSymlinks,
+		allowBrokenSymlinks: allowBrokenSymlinks,
+		ancestors:           map[string]bool{},
+	}
+	if followSymlinks {
+		var err error
+		if e.realIndir, err = filepath.EvalSymlinks(indir); err != nil {
+			return nil, err
+		}
+	}
+	outfiles := []string{}
+	for _, relfile := range infiles {
+		out, err := e.expand(relfile)
+		if err != nil {
+			return nil, err
+		}
+		outfiles = append(outfiles, out...)
+	}
+	return outfiles, nil
+}
+
+// expander holds the state of expandDirectoriesAndSymlinks.
+type expander struct {
+	indir string
+	// realIndir is indir with the symlinks resolved, only set when following
+	// symlinks.
+	realIndir           string
+	blacklist           func(string) bool
+	followSymlinks      bool
+	allowBrokenSymlinks bool
+	// ancestors are the real paths of the directories being expanded, to detect
+	// symlink cycles.
+	ancestors map[string]bool
+}
+
+// expand expands a single input. It can result in multiple outputs.
+//
+// This function is recursive when relfile is a directory.
+func (e *expander) expand(relfile string) ([]string, error) {
+	if path.IsAbs(relfile) || filepath.IsAbs(relfile) {
+		return nil, fmt.Errorf("can't map absolute path %s", relfile)
+	}
+	infile := filepath.Join(e.indir, filepath.FromSlash(relfile))
+	if !common.PathStartsWith(e.indir, infile) {
+		return nil, fmt.Errorf("can't map file %s outside %s", infile, e.indir)
+	}
+	// Special case './'.
+	relfile = strings.TrimPrefix(relfile, "./")
+
+	info, err := os.Lstat(infile)
+	if err != nil {
+		return nil, fmt.Errorf("input file %s doesn't exist", infile)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !e.followSymlinks {
+			// Links are mapped as links, even when they point to a directory, but
+			// they must not dangle nor escape the root directory.
+			if err := checkSymlink(e.indir, infile); err != nil && !e.allowBrokenSymlinks {
+				return nil, err
+			}
+			return []string{strings.TrimSuffix(relfile, "/")}, nil
+		}
+		// The target is mapped in place of the link.
+		target, err := filepath.EvalSymlinks(infile)
+		if err == nil {
+			info, err = os.Stat(target)
+		}
+		if err != nil {
+			if e.allowBrokenSymlinks {
+				log.Printf("warning: skipping dangling symlink %s", infile)
+				return []string{}, nil
+			}
+			return nil, fmt.Errorf("symlink %s is dangling", infile)
+		}
+		if !common.PathStartsWith(e.realIndir, target) {
+			if !e.allowBrokenSymlinks {
+				return nil, fmt.Errorf("symlink %s points to %s which is outside of %s", infile, target, e.indir)
+			}
+			log.Printf("warning: mapping %s outside of %s through symlink %s", target, e.indir, infile)
+		}
+		if info.IsDir() && !strings.HasSuffix(relfile, "/") {
+			relfile += "/"
+		}
+	}
+
+	if !strings.HasSuffix(relfile, "/") && relfile != "" {
+		// Always add individual files even if they were blacklisted.
+		if info.IsDir() {
+			return nil, fmt.Errorf("input directory %s must have a trailing slash", infile)
+		}
+		return []string{relfile}, nil
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory but ends with \"/\"", infile)
+	}
+	if e.followSymlinks {
+		real, err := filepath.EvalSymlinks(infile)
+		if err != nil {
+			return nil, err
+		}
+		if e.ancestors[real] {
+			return nil, fmt.Errorf("symlink cycle: %s is %s, one of its parent directories", infile, real)
+		}
+		e.ancestors[real] = true
+		defer delete(e.ancestors, real)
+	}
+	entries, err := ioutil.ReadDir(infile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to iterate over directory %s: %s", infile, err)
+	}
+	outfiles := []string{}
+	for _, entry := range entries {
+		innerRelfile := relfile + entry.Name()
+		if e.blacklist != nil && e.blacklist(innerRelfile) {
+			continue
+		}
+		if entry.IsDir() {
+			innerRelfile += "/"
+		}
+		out, err := e.expand(innerRelfile)
+		if err != nil {
+			return nil, err
+		}
+		outfiles = append(outfiles, out...)
+	}
+	return outfiles, nil
+}
+
+// checkSymlink returns an error if the symlink link is dangling or points
+// outside of root.
+func checkSymlink(root, link string) error {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return err
+	}
+	dest := target
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(link), dest)
+	}
+	if !common.PathStartsWith(root, dest) {
+		return fmt.Errorf("symlink %s points to %s which is outside of %s", link, target, root)
+	}
+	if _, err := os.Stat(link); err != nil {
+		return fmt.Errorf("symlink %s is dangling", link)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenBlacklist(t *testing.T) {
+	blacklist, err := genBlacklist(DEFAULT_BLACKLIST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		path     string
+		expected bool
+	}{
+		{".git", true},
+		{"a/.git", true},
+		{"a/b/.svn", true},
+		{"a/.gitignore", false},
+		{"a.git", false},
+		{"foo.pyc", true},
+		{"a/.foo.swp", true},
+		{"foo.py", false},
+		{".pyc", false},
+	}
+	for _, line := range data {
+		if got := blacklist(line.path); got != line.expected {
+			t.Errorf("blacklist(%q) = %v, expected %v", line.path, got, line.expected)
+		}
+	}
+
+	// Regexps are anchored at the start, like Python's re.match.
+	blacklist, err = genBlacklist([]string{`out`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blacklist("out/foo") || blacklist("a/out") {
+		t.Error("expected blacklist regexps to be anchored at the start")
+	}
+
+	if _, err := genBlacklist([]string{`(`}); err == nil {
+		t.Error("expected an error for an invalid regexp")
+	}
+}
+
+func TestExpandDirectoriesAndSymlinks(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"root/a/b.txt":         "b",
+		"root/a/b.pyc":         "b",
+		"root/a/.git/HEAD":     "ref",
+		"root/a/sub/c.txt":     "c",
+		"root/a/sub/empty/.ok": "",
+		"root/d.pyc":           "d",
+		"root/e.txt":           "e",
+		"outside.txt":          "outside",
+	})
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Symlink("sub", filepath.Join(root, "a", "link_dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../e.txt", filepath.Join(root, "a", "link_file")); err != nil {
+		t.Fatal(err)
+	}
+	blacklist, err := genBlacklist(DEFAULT_BLACKLIST)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := expandDirectoriesAndSymlinks(root, []string{"a/", "d.pyc", "./"}, blacklist, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded := []string{
+		"a/b.txt", "a/link_dir", "a/link_file", "a/sub/c.txt", "a/sub/empty/.ok",
+	}
+	// Individual files are always added, even if blacklisted.
+	expected := append(append(append([]string{}, expanded...), "d.pyc"), expanded...)
+	expected = append(expected, "e.txt")
+	if !reflect.DeepEqual(expected, out) {
+		t.Errorf("expected %v, got %v", expected, out)
+	}
+
+	// When following symlinks, the targets are mapped in place of the links.
+	if out, err = expandDirectoriesAndSymlinks(root, []string{"a/"}, blacklist, true, false); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"a/b.txt", "a/link_dir/c.txt", "a/link_dir/empty/.ok", "a/link_file", "a/sub/c.txt", "a/sub/empty/.ok"}
+	if !reflect.DeepEqual(expected, out) {
+		t.Errorf("expected %v, got %v", expected, out)
+	}
+}
+
+func TestExpandDirectoriesAndSymlinksBroken(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"root/a/b.txt": "b",
+		"outside.txt":  "outside",
+	})
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Symlink("missing", filepath.Join(root, "a", "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../outside.txt", filepath.Join(root, "a", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		infile         string
+		followSymlinks bool
+		expected       []string
+	}{
+		{"a/dangling", false, []string{"a/dangling"}},
+		{"a/escape", false, []string{"a/escape"}},
+		{"a/dangling", true, []string{}},
+		{"a/escape", true, []string{"a/escape"}},
+	}
+	for _, line := range data {
+		if _, err := expandDirectoriesAndSymlinks(root, []string{line.infile}, nil, line.followSymlinks, false); err == nil {
+			t.Errorf("%s: expected an error", line.infile)
+		}
+		out, err := expandDirectoriesAndSymlinks(root, []string{line.infile}, nil, line.followSymlinks, true)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", line.infile, err)
+		} else if !reflect.DeepEqual(line.expected, out) {
+			t.Errorf("%s: expected %v, got %v", line.infile, line.expected, out)
+		}
+	}
+}
+
+func TestExpandDirectoriesAndSymlinksFollow(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"root/a/b.txt":      "b",
+		"outside/c.txt":     "c",
+		"outside/sub/d.txt": "d",
+	})
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Symlink("..", filepath.Join(root, "a", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(root, "escape_dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not following the links, they are mapped as is.
+	out, err := expandDirectoriesAndSymlinks(root, []string{"a/"}, nil, false, false)
+	if err != nil || !reflect.DeepEqual([]string{"a/b.txt", "a/loop"}, out) {
+		t.Errorf("unexpected %v, %v", out, err)
+	}
+	// A link to a parent directory is a cycle, even when broken links are
+	// allowed.
+	for _, allow := range []bool{false, true} {
+		if _, err := expandDirectoriesAndSymlinks(root, []string{"a/"}, nil, true, allow); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("expected a cycle error, got %v", err)
+		}
+	}
+
+	// A directory outside the root is only mapped when allowed.
+	if _, err := expandDirectoriesAndSymlinks(root, []string{"escape_dir/"}, nil, true, false); err == nil || !strings.Contains(err.Error(), "outside of") {
+		t.Errorf("expected an outside error, got %v", err)
+	}
+	out, err = expandDirectoriesAndSymlinks(root, []string{"escape_dir/"}, nil, true, true)
+	if expected := []string{"escape_dir/c.txt", "escape_dir/sub/d.txt"}; err != nil || !reflect.DeepEqual(expected, out) {
+		t.Errorf("expected %v, got %v, %v", expected, out, err)
+	}
+}
+
+func TestExpandDirectoriesAndSymlinksErrors(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"root/a/b.txt": "b",
+		"outside.txt":  "outside",
+	})
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Symlink("../../outside.txt", filepath.Join(root, "a", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(root, "a", "missing_link")); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		infile   string
+		expected string
+	}{
+		{"a", "must have a trailing slash"},
+		{"a/b.txt/", "is not a directory"},
+		{"a/missing.txt", "doesn't exist"},
+		{"../outside.txt", "outside"},
+		{"/etc/passwd", "absolute path"},
+		{"a/escape", "outside of"},
+		{"a/missing_link", "dangling"},
+		{"a/", "outside of"},
+	}
+	for _, line := range data {
+		_, err := expandDirectoriesAndSymlinks(root, []string{line.infile}, nil, false, false)
+		if err == nil || !strings.Contains(err.Error(), line.expected) {
+			t.Errorf("%s: expected error containing %q, got %v", line.infile, line.expected, err)
+		}
+	}
+}
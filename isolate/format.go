@@ -5,7 +5,9 @@
 package isolate
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -50,7 +52,7 @@ func compareConfigNames(lhs, rhs ConfigName) int {
 }
 
 func (c *ConfigName) Equals(o ConfigName) bool {
-	return reflect.DeepEqual(c, o)
+	return reflect.DeepEqual(*c, o)
 }
 
 type ConfigPair struct {
@@ -249,7 +251,9 @@ func (c *Configs) expandConfigVariables(newConfigVars []string) []ConfigPair {
 //      the OS' native path separator. It must be an absolute path, it's the path
 //      where to start the command from.
 //  .files is the list of dependencies. The items use '/' as a path separator.
-//  .read_only describe how to map the files.
+//  .read_only describe how to map the files: 0 means writable, 1 means the
+//      files are read-only and 2 means the files and directories are read-only.
+//      -1 means it is not set, in which case the default 1 is used.
 type ConfigSettings struct {
 	Files      []string
 	Command    []string
@@ -297,7 +301,7 @@ func (lhs *ConfigSettings) Union(rhs ConfigSettings) (ConfigSettings, error) {
 	// Takes the difference between the two isolate_dir. Note that while
 	// isolate_dir is in native path case, all other references are in posix.
 	var useRhs bool
-	var command []string
+	command := []string{}
 	if len(lhs.Command) > 0 {
 		useRhs = false
 		command = lhs.Command
@@ -324,20 +328,30 @@ func (lhs *ConfigSettings) Union(rhs ConfigSettings) (ConfigSettings, error) {
 
 	var result ConfigSettings
 
-	rebasePath, err := filepath.Rel(rRelCwd, lRelCwd)
+	// Files of rhs are relative to rRelCwd, make them relative to lRelCwd.
+	rebasePath, err := filepath.Rel(lRelCwd, rRelCwd)
 	if err != nil {
 		return result, err
 	}
-	rebasePath = strings.Replace(rebasePath, string(os.PathSeparator), "/", 0)
-
-	files := make([]string, len(lFiles)+len(rFiles))
-	copy(files, lFiles)
-	for i, f := range rFiles {
+	rebasePath = filepath.ToSlash(rebasePath)
+
+	seen := map[string]bool{}
+	files := make([]string, 0, len(lFiles)+len(rFiles))
+	for _, f := range lFiles {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	for _, f := range rFiles {
 		// Rebase item.
 		if !(strings.HasPrefix(f, "<(") || rebasePath == ".") {
 			f = common.PosixpathJoin(rebasePath, f)
 		}
-		files[i+len(lFiles)] = f
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
 	}
 	sort.Strings(files)
 	result.Init(ParsedIsolate{command, files, readOnly}, lRelCwd)
@@ -361,12 +375,17 @@ func (p *UntypedIsolate) IsEmpty() bool {
 type ParsedIsolate struct {
 	Command []string `json:"command"`
 	Files   []string `json:"files"`
-	// TODO(tandrii): read_only has 1 as default, according to specs.
-	// Python-isolate also uses None as undefined, this code uses -1.
-	// Golang's default is currently just 0.
+	// ReadOnly is 0, 1 or 2, see ConfigSettings. Python-isolate uses None as
+	// undefined, this code uses -1; the saved state then keeps its default of
+	// 1.
 	ReadOnly int `json:"read_only"`
 }
 
+// newParsedIsolate returns an empty ParsedIsolate with read_only unset.
+func newParsedIsolate() ParsedIsolate {
+	return ParsedIsolate{Command: []string{}, Files: []string{}, ReadOnly: -1}
+}
+
 func (p *ParsedIsolate) IsEmpty() bool {
 	return len(p.Command) == 0 && len(p.Files) == 0
 }
@@ -403,11 +422,293 @@ func (p *ParsedIsolate) IsEmpty() bool {
 //    },
 //  }
 func LoadIsolateAsConfig(isolateDir string, content []byte, fileComment []byte) (Configs, error) {
-	var isolate Configs
-	// TODO: can we parse this without Python?
-	err := common.ExecPyHelperTyped(&isolate, "load_isolate_as_config", content, isolateDir)
-	isolate.FileComment = fileComment
-	return isolate, err
+	l := newIsolateLoader(nil)
+	return l.load("", isolateDir, content, fileComment)
+}
+
+// isolateLoader loads an .isolate file and, recursively, the files it
+// includes.
+type isolateLoader struct {
+	// knownValues are additional values of the config variables. See
+	// collectConfigValues for details.
+	knownValues KeyVars
+	// chain is the stack of .isolate files being loaded, the root first. It is
+	// used to detect include cycles and to report errors.
+	chain []string
+	// loaded is the set of .isolate files already merged. A file included
+	// several times, e.g. by two files that are themselves included by the
+	// root, is merged only once.
+	loaded map[string]bool
+}
+
+func newIsolateLoader(knownValues KeyVars) *isolateLoader {
+	return &isolateLoader{knownValues: knownValues, loaded: map[string]bool{}}
+}
+
+// chainString returns the include chain as "a.isolate -> b.isolate".
+func (l *isolateLoader) chainString() string {
+	files := make([]string, 0, len(l.chain))
+	for _, f := range l.chain {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return strings.Join(files, " -> ")
+}
+
+// wrapError adds the include chain to err, if the file being loaded is an
+// include.
+func (l *isolateLoader) wrapError(err error) error {
+	if len(l.chain) < 2 {
+		if len(l.chain) == 1 && l.chain[0] != "" {
+			return fmt.Errorf("%s: %s", l.chain[0], err)
+		}
+		return err
+	}
+	return fmt.Errorf("%s (included via %s): %s", l.chain[len(l.chain)-1], l.chainString(), err)
+}
+
+// load parses the content of isolateFile, which is in isolateDir, and merges
+// its includes. isolateFile may be empty if the content doesn't come from a
+// file.
+func (l *isolateLoader) load(isolateFile, isolateDir string, content []byte, fileComment []byte) (Configs, error) {
+	if !filepath.IsAbs(isolateDir) {
+		return Configs{}, fmt.Errorf("isolate dir %s must be absolute", isolateDir)
+	}
+	l.chain = append(l.chain, isolateFile)
+	defer func() { l.chain = l.chain[:len(l.chain)-1] }()
+	if isolateFile != "" {
+		l.loaded[isolateFile] = true
+	}
+
+	value, positions, err := parseLiteral(content)
+	if err != nil {
+		return Configs{}, l.wrapError(err)
+	}
+	root, err := verifyRoot(value, positions)
+	if err != nil {
+		return Configs{}, l.wrapError(err)
+	}
+	isolate, err := l.loadRoot(root, isolateDir, fileComment)
+	if err != nil {
+		return isolate, l.wrapError(err)
+	}
+
+	// Load the includes. Process them in reverse so the last one take precedence.
+	for i := len(root.includes) - 1; i >= 0; i-- {
+		include := root.includes[i]
+		if filepath.IsAbs(include) {
+			return isolate, l.wrapError(fmt.Errorf("absolute include path '%s' is not allowed", include))
+		}
+		includedFile := filepath.Join(isolateDir, filepath.FromSlash(include))
+		for _, f := range l.chain {
+			if f == includedFile {
+				return isolate, fmt.Errorf("include cycle: %s -> %s", l.chainString(), includedFile)
+			}
+		}
+		if l.loaded[includedFile] {
+			continue
+		}
+		includedContent, err := ioutil.ReadFile(includedFile)
+		if err != nil {
+			return isolate, l.wrapError(fmt.Errorf("failed to load include: %s", err))
+		}
+		included, err := l.load(includedFile, filepath.Dir(includedFile), includedContent, nil)
+		if err != nil {
+			return isolate, err
+		}
+		if isolate, err = isolate.Union(included); err != nil {
+			return isolate, l.wrapError(err)
+		}
+	}
+	return isolate, nil
+}
+
+// loadRoot converts the variables and conditions of a single .isolate file
+// into a Configs instance.
+func (l *isolateLoader) loadRoot(root isolateRoot, isolateDir string, fileComment []byte) (Configs, error) {
+	var err error
+
+	conditions := make([]condition, len(root.conditions))
+	for i, c := range root.conditions {
+		conditions[i] = c.condition
+	}
+	configVariables, configValues := collectConfigValues(conditions, l.knownValues)
+
+	isolate := Configs{}
+	isolate.Init(fileComment, configVariables)
+	// Add global variables. The global variables are on the empty tuple key.
+	globals := ConfigSettings{}
+	globals.Init(root.variables, isolateDir)
+	isolate.SetConfig(make(ConfigName, len(configVariables)), globals)
+
+	// Add configuration-specific variables.
+	for _, c := range root.conditions {
+		configs := Configs{}
+		configs.Init(nil, configVariables)
+		for _, key := range matchConfigs(c.condition, configVariables, configValues) {
+			settings := ConfigSettings{}
+			settings.Init(c.variables, isolateDir)
+			configs.SetConfig(key, settings)
+		}
+		if isolate, err = isolate.Union(configs); err != nil {
+			return isolate, err
+		}
+	}
+	return isolate, nil
+}
+
+// isolateRoot is the verified content of an .isolate file.
+type isolateRoot struct {
+	includes   []string
+	conditions []isolateCondition
+	variables  ParsedIsolate
+}
+
+// isolateCondition is one entry of the 'conditions' section.
+type isolateCondition struct {
+	expr      string
+	condition condition
+	variables ParsedIsolate
+}
+
+// verifyRoot verifies that value is the parsed form of a valid .isolate file.
+//
+// positions are the positions of the values as returned by parseLiteral. They
+// are used to report malformed conditions.
+func verifyRoot(value interface{}, positions map[string]textPos) (isolateRoot, error) {
+	out := isolateRoot{variables: newParsedIsolate()}
+	root, ok := value.(map[string]interface{})
+	if !ok {
+		return out, fmt.Errorf("expected a dict at the root, got %#v", value)
+	}
+	for _, key := range sortedKeys(root) {
+		v := root[key]
+		var err error
+		switch key {
+		case "includes":
+			out.includes, err = verifyStrings(key, v)
+		case "conditions":
+			out.conditions, err = verifyConditions(v, positions)
+		case "variables":
+			out.variables, err = verifyVariables(v)
+		default:
+			err = fmt.Errorf("unknown key '%s' at the root, expected one of includes, conditions, variables", key)
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func verifyConditions(value interface{}, positions map[string]textPos) ([]isolateCondition, error) {
+	conditions, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'conditions' must be a list, got %#v", value)
+	}
+	out := make([]isolateCondition, len(conditions))
+	for i, c := range conditions {
+		condition, ok := c.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("condition #%d must be a list, got %#v", i, c)
+		}
+		if len(condition) == 3 {
+			return nil, errors.New("using 'else' is not supported anymore")
+		}
+		if len(condition) != 2 {
+			return nil, fmt.Errorf("condition #%d must be [expr, {'variables': ...}], got %#v", i, c)
+		}
+		if out[i].expr, ok = condition[0].(string); !ok {
+			return nil, fmt.Errorf("condition #%d expression must be a string, got %#v", i, condition[0])
+		}
+		var err error
+		if out[i].condition, err = parseCondition(out[i].expr); err != nil {
+			pos := positions[fmt.Sprintf("conditions/%d/0", i)]
+			if cerr, ok := err.(*ConditionError); ok {
+				pos = exprColumn(pos, cerr.Column, out[i].expr)
+				return nil, fmt.Errorf("%s: %s in condition %q", pos, cerr.Msg, cerr.Expr)
+			}
+			return nil, fmt.Errorf("%s: %s", pos, err)
+		}
+		then, ok := condition[1].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("condition %q must be followed by a dict, got %#v", out[i].expr, condition[1])
+		}
+		for _, key := range sortedKeys(then) {
+			if key != "variables" {
+				return nil, fmt.Errorf("unknown key '%s' in condition %q", key, out[i].expr)
+			}
+		}
+		variables, ok := then["variables"]
+		if !ok {
+			return nil, fmt.Errorf("missing 'variables' in condition %q", out[i].expr)
+		}
+		if out[i].variables, err = verifyVariables(variables); err != nil {
+			return nil, fmt.Errorf("condition %q: %s", out[i].expr, err)
+		}
+	}
+	return out, nil
+}
+
+// verifyVariables verifies a 'variables' dict and converts it to a
+// ParsedIsolate.
+func verifyVariables(value interface{}) (ParsedIsolate, error) {
+	out := newParsedIsolate()
+	variables, ok := value.(map[string]interface{})
+	if !ok {
+		return out, fmt.Errorf("'variables' must be a dict, got %#v", value)
+	}
+	for _, key := range sortedKeys(variables) {
+		v := variables[key]
+		var err error
+		switch key {
+		case "command":
+			out.Command, err = verifyStrings(key, v)
+		case "files":
+			out.Files, err = verifyStrings(key, v)
+		case "read_only":
+			switch r := v.(type) {
+			case nil:
+			case int:
+				if r < 0 || r > 2 {
+					err = fmt.Errorf("'read_only' must be 0, 1 or 2, got %d", r)
+				}
+				out.ReadOnly = r
+			default:
+				err = fmt.Errorf("'read_only' must be 0, 1 or 2, got %#v", v)
+			}
+		default:
+			err = fmt.Errorf("unknown variable '%s', expected one of command, files, read_only", key)
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func verifyStrings(name string, value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'%s' must be a list, got %#v", name, value)
+	}
+	out := make([]string, len(list))
+	for i, item := range list {
+		if out[i], ok = item.(string); !ok {
+			return nil, fmt.Errorf("'%s' must only contain strings, got %#v", name, item)
+		}
+	}
+	return out, nil
 }
 
 // LoadIsolateForConfig loads the .isolate file and returns the information unprocessed but
@@ -417,9 +718,16 @@ func LoadIsolateAsConfig(isolateDir string, content []byte, fileComment []byte)
 // tuple of command, dependencies, read_only flag, isolate_dir.
 // The dependencies are fixed to use os.path.sep.
 func LoadIsolateForConfig(isolateDir string, content []byte, configVariables KeyVars) (
+	[]string, []string, int, string, error) {
+	return loadIsolateForConfig("", isolateDir, content, configVariables)
+}
+
+// loadIsolateForConfig is LoadIsolateForConfig for the .isolate file
+// isolateFile, which is used to detect include cycles and report errors.
+func loadIsolateForConfig(isolateFile, isolateDir string, content []byte, configVariables KeyVars) (
 	[]string, []string, int, string, error) {
 	// Load the .isolate file, process its conditions, retrieve the command and dependencies.
-	isolate, err := LoadIsolateAsConfig(isolateDir, content, nil)
+	isolate, err := newIsolateLoader(configVariables).load(isolateFile, isolateDir, content, nil)
 	if err != nil {
 		return nil, nil, -1, "", err
 	}
@@ -439,6 +747,29 @@ func LoadIsolateForConfig(isolateDir string, content []byte, configVariables Key
 	return config.Command, dependencies, config.ReadOnly, config.IsolateDir, nil
 }
 
+// determineRootDir determines the deepest root directory that is referenced
+// indirectly by infiles, which are relative to relativeRoot.
+//
+// All arguments must be using the native path separator.
+func determineRootDir(relativeRoot string, infiles []string) string {
+	// The trick used to determine the root directory is to look at "how far"
+	// back up it is looking up.
+	deepestRoot := relativeRoot
+	up := ".." + string(os.PathSeparator)
+	for _, i := range infiles {
+		i = filepath.Clean(i)
+		x := relativeRoot
+		for i == ".." || strings.HasPrefix(i, up) {
+			i = strings.TrimPrefix(strings.TrimPrefix(i, ".."), string(os.PathSeparator))
+			x = filepath.Dir(x)
+		}
+		if common.PathStartsWith(x, deepestRoot) {
+			deepestRoot = x
+		}
+	}
+	return deepestRoot
+}
+
 func computeConfigName(isolate Configs, configVariables KeyVars) (ConfigName, error) {
 	out := []ConfigValueOfKey{}
 	missingVars := []string{}
@@ -4,7 +4,16 @@
 
 package isolate
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+)
 
 func TestLoadIsolateAsConfig(t *testing.T) {
 	_, err := LoadIsolateAsConfig("/s/swarming", []byte("{}"), []byte("# filecomment"))
@@ -12,3 +21,212 @@ func TestLoadIsolateAsConfig(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLoadIsolateAsConfigVariables(t *testing.T) {
+	content := []byte(`{
+  'variables': {
+    'command': ['python', 'foo.py'],
+    'files': ['foo.py', 'data/',],
+    'read_only': 0,
+  },
+}`)
+	isolate, err := LoadIsolateAsConfig("/dir", content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ConfigSettings{
+		Files:      []string{"data/", "foo.py"},
+		Command:    []string{"python", "foo.py"},
+		ReadOnly:   0,
+		IsolateDir: "/dir",
+	}
+	config, err := isolate.GetConfig(ConfigName{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, config) {
+		t.Errorf("expected %#v, got %#v", expected, config)
+	}
+}
+
+func TestLoadIsolateAsConfigInvalid(t *testing.T) {
+	data := []string{
+		`[]`,
+		`{'foo': {}}`,
+		`{'variables': {'bar': []}}`,
+		`{'variables': {'files': 'a'}}`,
+		`{'variables': {'files': [1]}}`,
+		`{'variables': {'read_only': 3}}`,
+		`{'conditions': [['OS=="linux"']]}`,
+		`{'conditions': [['OS=="linux"', {}]]}`,
+		`{'conditions': [['OS=="linux"', {'variables': {}}, {}]]}`,
+	}
+	for _, content := range data {
+		if _, err := LoadIsolateAsConfig("/dir", []byte(content), nil); err == nil {
+			t.Errorf("expected error for %s", content)
+		}
+	}
+}
+
+func TestLoadIsolateForConfig(t *testing.T) {
+	content := []byte(`{
+  'variables': {
+    'files': ['common.txt'],
+  },
+  'conditions': [
+    ['OS=="linux" and (chromeos==1 or foo=="bar")', {
+      'variables': {
+        'command': ['linux_chromeos'],
+        'files': ['linux.txt'],
+      },
+    }],
+    ['OS!="win"', {
+      'variables': {
+        'files': ['posix.txt'],
+      },
+    }],
+  ],
+}`)
+	data := []struct {
+		vars    map[string]string
+		command []string
+		files   []string
+	}{
+		{map[string]string{"OS": "linux", "chromeos": "1", "foo": ""},
+			[]string{"linux_chromeos"}, []string{"common.txt", "linux.txt", "posix.txt"}},
+		{map[string]string{"OS": "linux", "chromeos": "0", "foo": "bar"},
+			[]string{"linux_chromeos"}, []string{"common.txt", "linux.txt", "posix.txt"}},
+		{map[string]string{"OS": "linux", "chromeos": "0", "foo": ""},
+			[]string{}, []string{"common.txt", "posix.txt"}},
+		{map[string]string{"OS": "android", "chromeos": "0", "foo": ""},
+			[]string{}, []string{"common.txt", "posix.txt"}},
+		{map[string]string{"OS": "win", "chromeos": "1", "foo": "bar"},
+			[]string{}, []string{"common.txt"}},
+	}
+	for _, line := range data {
+		command, files, _, _, err := LoadIsolateForConfig("/dir", content, line.vars)
+		if err != nil {
+			t.Errorf("%v: %s", line.vars, err)
+			continue
+		}
+		if !reflect.DeepEqual(line.command, command) || !reflect.DeepEqual(line.files, files) {
+			t.Errorf("%v: expected %v %v, got %v %v", line.vars, line.command, line.files, command, files)
+		}
+	}
+	if _, _, _, _, err := LoadIsolateForConfig("/dir", content, map[string]string{"OS": "linux"}); err == nil {
+		t.Error("expected error for missing config variables")
+	}
+}
+
+func TestLoadIsolateAsConfigBadCondition(t *testing.T) {
+	content := []byte("{\n  'conditions': [\n    ['OS==\"linux\" and', {'variables': {}}],\n  ],\n}")
+	_, err := LoadIsolateAsConfig("/dir", content, nil)
+	expected := `line 3, column 22: unexpected end of expression, expected a comparison in condition "OS==\"linux\" and"`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+// writeIsolates writes the .isolate files in a new temporary directory and
+// returns it.
+func writeIsolates(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "isolate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadIsolateIncludes(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"a/root.isolate": `{
+  'includes': ['../b/b.isolate', 'common.isolate'],
+  'variables': {'command': ['root.exe'], 'files': ['root.txt']},
+}`,
+		"a/common.isolate": `{'variables': {'files': ['common.txt', 'data/']}}`,
+		"b/b.isolate": `{
+  'includes': ['c/c.isolate', '../a/common.isolate'],
+  'conditions': [
+    ['OS=="linux"', {'variables': {'files': ['b_linux.txt']}}],
+  ],
+}`,
+		"b/c/c.isolate":   `{'includes': ['d/d.isolate'], 'variables': {'files': ['c.txt']}}`,
+		"b/c/d/d.isolate": `{'includes': ['e/e.isolate'], 'variables': {'files': ['d.txt']}}`,
+		"b/c/d/e/e.isolate": `{
+  'variables': {
+    'command': ['e.exe'],
+    'files': ['e.txt', '<(PRODUCT_DIR)/e.bin'],
+    'read_only': 2,
+  },
+}`,
+	})
+	defer os.RemoveAll(dir)
+	rootDir := filepath.Join(dir, "a")
+	root := filepath.Join(rootDir, "root.isolate")
+	content, _ := ioutil.ReadFile(root)
+	command, files, readOnly, isolateDir, err := loadIsolateForConfig(root, rootDir, content, KeyVars{"OS": "linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := []string{
+		"../b/b_linux.txt", "../b/c/c.txt", "../b/c/d/d.txt", "../b/c/d/e/e.txt",
+		"<(PRODUCT_DIR)/e.bin", "common.txt", "data/", "root.txt",
+	}
+	for i, f := range expectedFiles {
+		expectedFiles[i] = filepath.FromSlash(f)
+	}
+	if !reflect.DeepEqual(expectedFiles, files) {
+		t.Errorf("expected %v, got %v", expectedFiles, files)
+	}
+	if !reflect.DeepEqual([]string{"root.exe"}, command) || readOnly != 2 {
+		t.Errorf("unexpected command %v and read_only %d", command, readOnly)
+	}
+	if isolateDir != rootDir {
+		t.Errorf("expected %s, got %s", rootDir, isolateDir)
+	}
+}
+
+func TestLoadIsolateIncludesErrors(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"cycle.isolate":   `{'includes': ['sub/a.isolate']}`,
+		"sub/a.isolate":   `{'includes': ['b.isolate']}`,
+		"sub/b.isolate":   `{'includes': ['../cycle.isolate']}`,
+		"missing.isolate": `{'includes': ['sub/c.isolate']}`,
+		"sub/c.isolate":   `{'includes': ['nope.isolate']}`,
+		"bad.isolate":     `{'includes': ['sub/bad.isolate']}`,
+		"sub/bad.isolate": `{'variables': {'files': [1]}}`,
+		"abs.isolate":     `{'includes': ['/abs.isolate']}`,
+	})
+	defer os.RemoveAll(dir)
+	p := func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	}
+	data := []struct {
+		name     string
+		expected string
+	}{
+		{"cycle.isolate", "include cycle: " + p("cycle.isolate") + " -> " + p("sub/a.isolate") + " -> " +
+			p("sub/b.isolate") + " -> " + p("cycle.isolate")},
+		{"missing.isolate", p("sub/c.isolate") + " (included via " + p("missing.isolate") + " -> " +
+			p("sub/c.isolate") + "): failed to load include: open " + p("sub/nope.isolate")},
+		{"bad.isolate", p("sub/bad.isolate") + " (included via " + p("bad.isolate") + " -> " +
+			p("sub/bad.isolate") + "): 'files' must only contain strings"},
+		{"abs.isolate", p("abs.isolate") + ": absolute include path '/abs.isolate' is not allowed"},
+	}
+	for _, line := range data {
+		content, _ := ioutil.ReadFile(p(line.name))
+		_, _, _, _, err := loadIsolateForConfig(p(line.name), dir, content, nil)
+		if err == nil || !strings.HasPrefix(err.Error(), line.expected) {
+			t.Errorf("%s: expected %q, got %v", line.name, line.expected, err)
+		}
+	}
+}
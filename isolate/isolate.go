@@ -6,6 +6,7 @@
 package isolate
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,25 +16,26 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/maruel/interrupt"
 
-	"crypto/sha1"
-
 	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
 	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
 )
 import . "chromium.googlesource.com/infra/swarming/client-go/internal/types"
 
 const ISOLATED_GEN_JSON_VERSION = 1
+const SAVED_STATE_VERSION = "1.0"
 const VALID_VARIABLE = "[A-Za-z_][A-Za-z_0-9]*"
 const DISK_FILE_CHUNK = 1024 * 1024
 
-var VALID_VARIABLE_MATCHER = regexp.MustCompile(VALID_VARIABLE)
+var VALID_VARIABLE_MATCHER = regexp.MustCompile("^" + VALID_VARIABLE + "$")
 
 func IsValidVariable(variable string) bool {
 	return VALID_VARIABLE_MATCHER.MatchString(variable)
@@ -53,60 +55,39 @@ type ArchiveOptions struct {
 	PathVariables   KeyVars  `json:"path_variables"`
 	ExtraVariables  KeyVars  `json:"extra_variables"`
 	ConfigVariables KeyVars  `json:"config_variables"`
+	// MaxConcurrentIO limits the number of files read concurrently when
+	// hashing. 0 means no limit besides the number of CPUs.
+	MaxConcurrentIO int `json:"max_concurrent_io"`
+	// FollowSymlinks maps the target of the symlinks instead of the links.
+	FollowSymlinks bool `json:"follow_symlinks"`
+	// AllowBrokenSymlinks permits dangling symlinks and symlinks pointing
+	// outside of the root directory instead of failing.
+	AllowBrokenSymlinks bool `json:"allow_broken_symlinks"`
 }
 
-// NewArchiveOptions initializes with non-nil values
+// NewArchiveOptions initializes with non-nil values. Blacklist starts with
+// DEFAULT_BLACKLIST.
 func (a *ArchiveOptions) Init() {
-	a.Blacklist = []string{}
+	a.Blacklist = append([]string{}, DEFAULT_BLACKLIST...)
 	a.PathVariables = map[string]string{}
 	a.ExtraVariables = map[string]string{}
 	a.ConfigVariables = map[string]string{}
 }
 
-type FileMetadata map[string]string
-
-func (m *FileMetadata) IsSymlink() bool {
-	return (*m)["l"] != ""
-}
-func (m *FileMetadata) IsHighPriority() bool {
-	return (*m)["priority"] == "0"
-}
-func (m *FileMetadata) GetDigest() string {
-	return (*m)["h"]
-}
-
-func (m *FileMetadata) GetSize() (int64, error) {
-	return strconv.ParseInt((*m)["s"], 10, 64)
-}
-
 type FileAsset struct {
 	FileMetadata
 	fullPath string
 }
 
-func (f *FileAsset) GetSize() int64 {
-	if size, err := f.FileMetadata.GetSize(); err != nil {
-		size, err = common.GetFileSize(f.fullPath)
-		if err != nil {
-			// TODO(tandrii): handle this error
-			panic(err)
-		}
-		return size
-	} else {
-		return size
-	}
-}
-
 func (fa *FileAsset) ToUploadItem() isolateserver.UploadItem {
-	// TODO(tandrii): get_zip_compression_level.
 	f := isolateserver.FileItem{
-		isolateserver.Item{
-			Digest:           fa.FileMetadata["h"],
-			Size:             fa.GetSize(),
+		Item: isolateserver.Item{
+			Digest:           fa.Digest,
+			Size:             fa.Size,
 			HighPriority:     fa.IsHighPriority(),
-			CompressionLevel: 6,
+			CompressionLevel: isolateserver.GetZipCompressionLevel(fa.fullPath),
 		},
-		fa.fullPath,
+		Path: fa.fullPath,
 	}
 	return &f
 }
@@ -116,8 +97,8 @@ type SavedState struct {
 	// different OS. While this should never happen in practice, users are ...
 	// "creative".
 	OS string `json:"OS"`
-	// Algorithm used to generate the hash. The only supported value is at the
-	// time of writting 'sha-1'.
+	// Algorithm used to generate the hash, one of
+	// isolateserver.SUPPORTED_ALGOS. It is derived from the namespace.
 	Algo string `json:"algo"`
 	// List of included .isolated files. Used to support/remember 'slave'
 	// .isolated files. Relative path to isolated_basedir.
@@ -139,8 +120,10 @@ type SavedState struct {
 	// GYP variables used to generate the .isolated files paths based on path
 	// variables. Frequent examples are DEPTH and PRODUCT_DIR.
 	PathVariables KeyVars `json:"PathVariables"`
-	// If the generated directory tree should be read-only. Defaults to 1.
-	ReadOnly bool `json:"read_only"`
+	// If the generated directory tree should be read-only: 0 means writable, 1
+	// means the files are read-only and 2 means the files and directories are
+	// read-only. Defaults to 1.
+	ReadOnly int `json:"read_only"`
 	// Relative cwd to use to start the command.
 	RelativeCwd string `json:"relative_cwd"`
 	// Root directory the files are mapped from.
@@ -154,23 +137,254 @@ type SavedState struct {
 	isolatedBasedir string
 }
 
+// Init initializes an empty SavedState for .isolated files in isolatedBasedir.
+func (ss *SavedState) Init(isolatedBasedir string) {
+	ss.OS = runtime.GOOS
+	ss.Algo = "sha-1"
+	ss.ChildIsolatedFiles = []string{}
+	ss.Command = []string{}
+	ss.ConfigVariables = KeyVars{}
+	ss.ExtraVariables = KeyVars{}
+	ss.Files = map[string]FileMetadata{}
+	ss.IsolateFile = ""
+	ss.PathVariables = KeyVars{}
+	ss.ReadOnly = 1
+	ss.RelativeCwd = ""
+	ss.RootDir = ""
+	ss.Version = SAVED_STATE_VERSION
+	ss.isolatedBasedir = isolatedBasedir
+}
+
+// Load loads a saved state serialized as JSON.
+//
+// It is not possible to load a .isolated.state file from a different OS, this
+// file is saved in OS-specific format. Unlike .isolated files, a non-exact
+// version is refused, even for a minor difference, since the state could have
+// changed significantly.
+func (ss *SavedState) Load(data []byte, isolatedBasedir string) error {
+	ss.Init(isolatedBasedir)
+	// read_only is decoded separately since older versions saved it as a bool.
+	type savedState SavedState
+	in := struct {
+		*savedState
+		ReadOnly json.RawMessage `json:"read_only"`
+	}{savedState: (*savedState)(ss)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.ReadOnly != nil && string(in.ReadOnly) != "null" {
+		var legacy bool
+		if err := json.Unmarshal(in.ReadOnly, &legacy); err == nil {
+			ss.ReadOnly = 0
+			if legacy {
+				ss.ReadOnly = 1
+			}
+		} else if err := json.Unmarshal(in.ReadOnly, &ss.ReadOnly); err != nil {
+			return fmt.Errorf("invalid read_only %s", in.ReadOnly)
+		}
+	}
+	if ss.ReadOnly < 0 || ss.ReadOnly > 2 {
+		return fmt.Errorf("read_only must be 0, 1 or 2, got %d", ss.ReadOnly)
+	}
+	if ss.OS != runtime.GOOS {
+		return fmt.Errorf("unexpected OS %s", ss.OS)
+	}
+	if _, ok := isolateserver.SUPPORTED_ALGOS[ss.Algo]; !ok {
+		return fmt.Errorf("unknown algo '%s'", ss.Algo)
+	}
+	if ss.Version != SAVED_STATE_VERSION {
+		return fmt.Errorf("unsupported version '%s'", ss.Version)
+	}
+	// JSON null leaves nil values behind.
+	if ss.ChildIsolatedFiles == nil {
+		ss.ChildIsolatedFiles = []string{}
+	}
+	if ss.Command == nil {
+		ss.Command = []string{}
+	}
+	for _, m := range []*KeyVars{&ss.ConfigVariables, &ss.ExtraVariables, &ss.PathVariables} {
+		if *m == nil {
+			*m = KeyVars{}
+		}
+	}
+	if ss.Files == nil {
+		ss.Files = map[string]FileMetadata{}
+	}
+	// The .isolate file must be valid. If it is not present anymore, zap the
+	// value as if it was not noted, so IsolateFile can safely be overriden
+	// later.
+	if ss.IsolateFile != "" {
+		ss.isolateFilepath = filepath.Join(isolatedBasedir, ss.IsolateFile)
+		if fi, err := os.Stat(ss.isolateFilepath); err != nil || fi.IsDir() {
+			ss.IsolateFile = ""
+			ss.isolateFilepath = ""
+		}
+	}
+	return nil
+}
+
+// LoadFile loads the saved state from stateFile. If the file doesn't exist, an
+// empty state is initialized instead.
+func (ss *SavedState) LoadFile(stateFile, isolatedBasedir string) error {
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		ss.Init(isolatedBasedir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := ss.Load(data, isolatedBasedir); err != nil {
+		return fmt.Errorf("failed to load %s: %s", stateFile, err)
+	}
+	return nil
+}
+
 func (ss *SavedState) UpdateConfig(newConfigVariables KeyVars) {
 	for k, v := range newConfigVariables {
 		ss.ConfigVariables[k] = v
 	}
 }
 
+// Update updates the saved state with new data to keep GYP variables and
+// internal reference to the original .isolate file.
+func (ss *SavedState) Update(isolateFile string, pathVariables, extraVariables KeyVars) error {
+	assert(filepath.IsAbs(isolateFile), isolateFile)
+	// Convert back to a relative path.
+	relIsolate, err := filepath.Rel(ss.isolatedBasedir, isolateFile)
+	if err != nil {
+		return err
+	}
+	// The same .isolate file should always be used to generate the .isolated
+	// file.
+	if ss.IsolateFile != "" && ss.IsolateFile != relIsolate {
+		return fmt.Errorf("loaded the wrong state file; the .isolate file was moved from %s to %s",
+			ss.IsolateFile, relIsolate)
+	}
+	ss.IsolateFile = relIsolate
+	ss.isolateFilepath = isolateFile
+	for k, v := range pathVariables {
+		ss.PathVariables[k] = v
+	}
+	for k, v := range extraVariables {
+		ss.ExtraVariables[k] = v
+	}
+	return nil
+}
+
+// UpdateIsolated updates the saved state with data necessary to generate a
+// .isolated file.
+//
+// The new files in infiles are added to Files but their hash is not
+// calculated here. Files that are not a dependency anymore are pruned.
+func (ss *SavedState) UpdateIsolated(command, infiles []string, readOnly int, relativeCwd string) {
+	ss.Command = command
+	wanted := map[string]bool{}
+	for _, f := range infiles {
+		wanted[f] = true
+		if _, ok := ss.Files[f]; !ok {
+			ss.Files[f] = FileMetadata{Mode: -1}
+		}
+	}
+	for f := range ss.Files {
+		if !wanted[f] {
+			delete(ss.Files, f)
+		}
+	}
+	if readOnly != -1 {
+		ss.ReadOnly = readOnly
+	}
+	ss.RelativeCwd = relativeCwd
+}
+
+// ToIsolated returns the content of the .isolated file for the saved state.
+func (ss *SavedState) ToIsolated() *isolateserver.Isolated {
+	out := isolateserver.NewIsolated(ss.Algo)
+	for f, meta := range ss.Files {
+		out.Files[f] = meta.toIsolatedFile()
+	}
+	readOnly := ss.ReadOnly
+	out.ReadOnly = &readOnly
+	if len(ss.Command) != 0 {
+		out.Command = ss.Command
+		// Only set relative_cwd if a command was also specified. This reduces
+		// the noise for Swarming tasks where the command is specified as part
+		// of the Swarming task request and not thru the .isolated file.
+		out.RelativeCwd = ss.RelativeCwd
+	}
+	return out
+}
+
 type CompleteState struct {
 	SavedState
+	// Absolute path of the .isolated file, if any.
+	isolatedFilepath string
+	// If symlinks are replaced by their target, see ArchiveOptions.
+	followSymlinks bool
 }
 
+// LoadFromIsolated loads the saved state associated with the .isolated file,
+// i.e. "foo.isolated.state", if it exists.
 func (cs *CompleteState) LoadFromIsolated(isolated string) error {
-	return nil
+	assert(filepath.IsAbs(isolated), isolated)
+	cs.isolatedFilepath = isolated
+	return cs.SavedState.LoadFile(common.IsolatedFileToState(isolated), filepath.Dir(isolated))
+}
+
+// SaveFiles creates the .isolated file and saves the state next to it, so the
+// next run can skip hash calculation of the files that didn't change.
+//
+// Large trees are split into child .isolated files, named like
+// "foo.0.isolated", which are referenced from the 'includes' section of the
+// main one.
+func (cs *CompleteState) SaveFiles() error {
+	if cs.isolatedFilepath == "" {
+		return errors.New("can't save a state without an .isolated file")
+	}
+	isolated := cs.SavedState.ToIsolated()
+	children := shardIsolated(isolated, ISOLATED_MAX_FILES)
+	cs.ChildIsolatedFiles = []string{}
+	base := strings.TrimSuffix(cs.isolatedFilepath, ".isolated")
+	for i, child := range children {
+		childPath := fmt.Sprintf("%s.%d.isolated", base, i)
+		if err := isolateserver.SaveIsolated(childPath, child); err != nil {
+			return err
+		}
+		h, err := HashFile(childPath, cs.Algo)
+		if err != nil {
+			return err
+		}
+		isolated.Includes = append(isolated.Includes, IsolateHash(h))
+		cs.ChildIsolatedFiles = append(cs.ChildIsolatedFiles, filepath.Base(childPath))
+	}
+	if err := isolateserver.SaveIsolated(cs.isolatedFilepath, isolated); err != nil {
+		return err
+	}
+	data, err := isolateserver.CanonicalJSON(&cs.SavedState)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(common.IsolatedFileToState(cs.isolatedFilepath), data, 0666)
 }
+
+// InitializeDummy constructs a state that cannot be saved, using cwd as the
+// directory containing the .isolated file.
 func (cs *CompleteState) InitializeDummy(cwd string) {
+	cs.isolatedFilepath = ""
+	cs.SavedState.Init(cwd)
 }
-func (cs *CompleteState) InitIgnoreSavedState() {
+
+// InitIgnoreSavedState constructs an empty state for the .isolated file,
+// ignoring any saved state.
+func (cs *CompleteState) InitIgnoreSavedState(isolated string) {
+	cs.isolatedFilepath = isolated
+	cs.SavedState.Init(filepath.Dir(isolated))
 }
+
+// LoadFromIsolate updates the saved state with information loaded from a
+// .isolate file.
+//
+// Processes the loaded data, deduce RootDir and RelativeCwd.
 func (cs *CompleteState) LoadFromIsolate(cwd, isolateFile string, opts ArchiveOptions) error {
 	if !filepath.IsAbs(isolateFile) {
 		panic(fmt.Errorf("isolateFile must be absolute path."))
@@ -187,31 +401,173 @@ func (cs *CompleteState) LoadFromIsolate(cwd, isolateFile string, opts ArchiveOp
 	if err != nil {
 		return fmt.Errorf("failed to read isolate file %s", isolateFile)
 	}
-	command, infiles, readOnly, isolateCmdDir, err := LoadIsolateForConfig(
-		filepath.Dir(isolateFile), isolateFileData, cs.SavedState.ConfigVariables)
+	command, infiles, readOnly, isolateCmdDir, err := loadIsolateForConfig(
+		isolateFile, filepath.Dir(isolateFile), isolateFileData, cs.SavedState.ConfigVariables)
 	if err != nil {
-		return fmt.Errorf("failed to parse isolate %s", isolateFile)
+		return fmt.Errorf("failed to parse isolate %s: %s", isolateFile, err)
 	}
-	log.Println(command, infiles, readOnly, isolateCmdDir)
-	return errors.New("TODO(tandrii)")
-}
-func (cs *CompleteState) FilesToMetadata() error {
-	//TODO(tandrii): need sorting? For determinism?
-	var err error
-	for f, meta := range cs.SavedState.Files {
-		filepath := path.Join(cs.RootDir, f)
-		if cs.SavedState.Files[f], err = FileToMetadata(filepath, meta, cs.ReadOnly, cs.Algo); err != nil {
+
+	// Processes the variables with the new found relative root. Note that 'cwd'
+	// is used when path variables are used.
+	pathVariables, err := normalizePathVariables(cwd, opts.PathVariables, isolateCmdDir)
+	if err != nil {
+		return err
+	}
+	// Update the rest of the saved state.
+	if err := cs.SavedState.Update(isolateFile, pathVariables, opts.ExtraVariables); err != nil {
+		return err
+	}
+
+	s := variableSubstitutor{isolateFile, cs.PathVariables, cs.ExtraVariables, cs.ConfigVariables}
+	if command, err = s.command(command); err != nil {
+		return err
+	}
+	if infiles, err = s.files(infiles); err != nil {
+		return err
+	}
+
+	// RootDir is automatically determined by the deepest root accessed with the
+	// form '../../foo/bar'. Note that path variables must be taken in account
+	// too, add them as if they were input files.
+	roots := append([]string{}, infiles...)
+	for _, v := range cs.PathVariables {
+		roots = append(roots, v)
+	}
+	cs.RootDir = determineRootDir(isolateCmdDir, roots)
+	// The relative directory is automatically determined by the relative path
+	// between RootDir and the directory containing the .isolate file.
+	relativeCwd, err := filepath.Rel(cs.RootDir, isolateCmdDir)
+	if err != nil {
+		return err
+	}
+	// Now that we know where the root is, check that the path variables point
+	// inside it.
+	for k, v := range cs.PathVariables {
+		dest := filepath.Join(isolateCmdDir, v)
+		if !common.PathStartsWith(cs.RootDir, dest) {
+			return fmt.Errorf("path variable %s=%s points outside the inferred root directory %s; %s",
+				k, v, cs.RootDir, dest)
+		}
+	}
+	// Normalize the files based to RootDir. It is important to keep the
+	// trailing separator at that step since it denotes a directory.
+	sep := string(os.PathSeparator)
+	for i, f := range infiles {
+		rel, err := filepath.Rel(cs.RootDir, filepath.Join(isolateCmdDir, f))
+		if err != nil {
 			return err
 		}
+		if strings.HasSuffix(f, sep) {
+			rel += sep
+		}
+		infiles[i] = filepath.ToSlash(rel)
+	}
+	// Expand the directories by listing each file inside. Up to now, there was
+	// no symlink processing, links are kept as links.
+	blacklist, err := genBlacklist(opts.Blacklist)
+	if err != nil {
+		return err
+	}
+	if infiles, err = expandDirectoriesAndSymlinks(cs.RootDir, infiles, blacklist, opts.FollowSymlinks, opts.AllowBrokenSymlinks); err != nil {
+		return err
+	}
+	cs.followSymlinks = opts.FollowSymlinks
+
+	// Finally, update the new data to be able to generate the .isolated file.
+	cs.SavedState.UpdateIsolated(command, infiles, readOnly, filepath.ToSlash(relativeCwd))
+	return nil
+}
+
+// FilesToMetadata updates the metadata of all the files, hashing the ones
+// that changed.
+//
+// Files are processed by a pool of workers sized to the CPU count.
+// maxConcurrentIO limits the number of files read concurrently, 0 means no
+// limit besides the number of workers. The work stops on the first error or
+// when interrupt.Channel is closed.
+//
+// cache, if not nil, is used to look up and record the digests.
+func (cs *CompleteState) FilesToMetadata(cache *HashCache, maxConcurrentIO int) error {
+	return cs.filesToMetadata(cache, runtime.NumCPU(), maxConcurrentIO)
+}
+
+func (cs *CompleteState) filesToMetadata(cache *HashCache, workers, maxConcurrentIO int) error {
+	// Process the files in a deterministic order. Results are stored by index
+	// and only merged back once all the files are processed.
+	files := make([]string, 0, len(cs.Files))
+	for f := range cs.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	results := make([]FileMetadata, len(files))
+
+	var ioSlots chan struct{}
+	if maxConcurrentIO > 0 {
+		ioSlots = make(chan struct{}, maxConcurrentIO)
+	}
+	abort := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(abort)
+		})
+	}
+
+	chIndexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chIndexes {
+				if ioSlots != nil {
+					select {
+					case ioSlots <- struct{}{}:
+					case <-abort:
+						continue
+					}
+				}
+				meta, err := FileToMetadata(path.Join(cs.RootDir, files[i]), cs.Files[files[i]], cs.ReadOnly, cs.Algo, cache, cs.followSymlinks)
+				if ioSlots != nil {
+					<-ioSlots
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
+				results[i] = meta
+			}
+		}()
+	}
+feed:
+	for i := range files {
+		select {
+		case chIndexes <- i:
+		case <-abort:
+			break feed
+		case <-interrupt.Channel:
+			fail(errors.New("interrupted"))
+			break feed
+		}
+	}
+	close(chIndexes)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	for i, f := range files {
+		cs.Files[f] = results[i]
 	}
 	return nil
 }
 
 func HashFile(filepath, algo string) (string, error) {
-	if algo != "sha-1" {
-		return "", fmt.Errorf("%s is not supported, only sha-1", algo)
+	h, err := isolateserver.NewHash(algo)
+	if err != nil {
+		return "", err
 	}
-	h := sha1.New()
 	f, err := os.Open(filepath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open %s: %s", filepath, err)
@@ -230,27 +586,36 @@ func HashFile(filepath, algo string) (string, error) {
 
 // FileToMetadata processes an input file, a dependency, and return meta data about it.
 //
-//  Behaviors:
-//  - Retrieves the file mode, file size, file timestamp, file link
-//    destination if it is a file link and calcultate the SHA-1 of the file's
-//    content if the path points to a file and not a symlink.
+//	Behaviors:
+//	- Retrieves the file mode, file size, file timestamp, file link
+//	  destination if it is a file link and calcultate the SHA-1 of the file's
+//	  content if the path points to a file and not a symlink.
 //
-//  Arguments:
-//    filePath: File to act on.
-//    prevdict: the previous dictionary. It is used to retrieve the cached sha-1
-//              to skip recalculating the hash. Optional.
-//    read_only: If 1 or 2, the file mode is manipulated. In practice, only save
-//               one of 4 modes: 0755 (rwx), 0644 (rw), 0555 (rx), 0444 (r). On
-//               windows, mode is not set since all files are 'executable' by
-//               default.
-//    algo:      Hashing algorithm used.
+//	Arguments:
+//	  filePath: File to act on.
+//	  prevdict: the previous dictionary. It is used to retrieve the cached sha-1
+//	            to skip recalculating the hash. Optional.
+//	  read_only: If 1 or 2, the file mode is manipulated. In practice, only save
+//	             one of 4 modes: 0755 (rwx), 0644 (rw), 0555 (rx), 0444 (r). On
+//	             windows, mode is not set since all files are 'executable' by
+//	             default. Directories are only affected by 2, when the tree is
+//	             mapped.
+//	  algo:      Hashing algorithm used.
+//	  cache:     HashCache used to skip recalculating the hash of files seen
+//	             before. Optional, it is ignored if it uses another algorithm.
+//	  collapseSymlinks: True if symlinked files should be treated like they
+//	                    were the normal underlying file.
 //
-//  Returns:
-//    The necessary dict to create a entry in the 'files' section of an .isolated
-//    file.
-func FileToMetadata(filePath string, prev FileMetadata, readOnly bool, algo string) (FileMetadata, error) {
-	out := FileMetadata{}
-	filestats, err := os.Lstat(filePath)
+//	Returns:
+//	  The necessary dict to create a entry in the 'files' section of an .isolated
+//	  file.
+func FileToMetadata(filePath string, prev FileMetadata, readOnly int, algo string, cache *HashCache, collapseSymlinks bool) (FileMetadata, error) {
+	out := FileMetadata{Mode: -1}
+	lstat := os.Lstat
+	if collapseSymlinks {
+		lstat = os.Stat
+	}
+	filestats, err := lstat(filePath)
 	if err != nil {
 		return out, fmt.Errorf("file %s is missing", filePath)
 	}
@@ -262,7 +627,7 @@ func FileToMetadata(filePath string, prev FileMetadata, readOnly bool, algo stri
 		filemode := int32(mask & filestats.Mode())
 		// Remove write access for group and all access to 'others'.
 		filemode &= ^(unix.S_IWGRP | unix.S_IRWXO)
-		if readOnly {
+		if readOnly != 0 {
 			filemode &= ^(unix.S_IWUSR)
 		}
 		if filemode&(unix.S_IXUSR|unix.S_IRGRP) == (unix.S_IXUSR | unix.S_IRGRP) {
@@ -271,51 +636,42 @@ func FileToMetadata(filePath string, prev FileMetadata, readOnly bool, algo stri
 		} else {
 			filemode &= ^unix.S_IXGRP
 		}
-		if is_link {
-			out["m"] = string(filemode)
+		if !is_link {
+			out.Mode = int(filemode)
 		}
 	}
 
-	// Used to skip recalculating the hash or link destination. Use the most recent# update time.
-	// TODO(tandrii): is rounding tstamp important? Also, what unit is this?
-	out["t"] = string(filestats.ModTime().Unix())
+	// Used to skip recalculating the hash or link destination. Use the most
+	// recent update time, rounded to the second like the Python client does.
+	out.Timestamp = (filestats.ModTime().UnixNano() + 5e8) / 1e9
 	if !is_link {
+		out.Size = filestats.Size()
 		// If the timestamp wasn't updated and the file size is still the same, carry on the sha-1.
-		if prev["t"] == out["t"] && prev["s"] == out["s"] {
+		if prev.Timestamp == out.Timestamp && prev.Size == out.Size {
 			// Reuse the previous hash if available.
-			out["h"] = prev["h"]
+			out.Digest = prev.Digest
 		}
-		if out["h"] == "" {
-			if out["h"], err = HashFile(filePath, algo); err != nil {
-				return out, err
-			}
+		if cache != nil && cache.Algo() != algo {
+			cache = nil
+		}
+		if out.Digest == "" && cache != nil {
+			out.Digest, err = cache.HashFile(filePath, filestats)
+		} else if out.Digest == "" {
+			out.Digest, err = HashFile(filePath, algo)
+		} else if cache != nil {
+			cache.add(filestats, out.Digest)
+		}
+		if err != nil {
+			return out, err
 		}
 	} else {
 		// If the timestamp wasn't updated, carry on the link destination.
-		if prev["t"] == out["t"] {
+		if prev.Timestamp == out.Timestamp {
 			// Reuse the previous link destination if available.
-			out["l"] = prev["l"]
-		}
-		if out["l"] == "" {
-			// The link could be in an incorrect path case. In practice, this only
-			// happen on OSX on case insensitive HFS.
-			// TODO(maruel): It'd be better if it was only done once, in
-			// expand_directory_and_symlink(), so it would not be necessary to do again
-			// here.
-			symlinkValue, err := os.Readlink(filePath)
-			if err != nil {
-				return out, err
-			}
-			filedir, err := common.GetNativePathCase(path.Dir(filePath))
-			if err != nil {
-				return out, err
-			}
-			nativeDest, err := common.FixNativePathCase(filedir, symlinkValue)
-			if err != nil {
-				return out, err
-			}
-			out["l"], err = filepath.Rel(nativeDest, filedir)
-			if err != nil {
+			out.Link = prev.Link
+		}
+		if out.Link == "" {
+			if out.Link, err = readRelativeLink(filePath); err != nil {
 				return out, err
 			}
 		}
@@ -323,7 +679,28 @@ func FileToMetadata(filePath string, prev FileMetadata, readOnly bool, algo stri
 	return out, nil
 }
 
-func loadcompleteState(opts ArchiveOptions, cwd string, skipUpdate bool) (CompleteState, error) {
+// readRelativeLink returns the destination of the symlink link as a posix
+// style path relative to the directory containing the link. Relative
+// destinations are kept as is.
+func readRelativeLink(link string) (string, error) {
+	dest, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(dest) {
+		if dest, err = filepath.Rel(filepath.Dir(link), dest); err != nil {
+			return "", err
+		}
+	}
+	return filepath.ToSlash(dest), nil
+}
+
+// loadcompleteState loads the saved state, if any, and the .isolate file.
+//
+// algo is the hashing algorithm used for the files; a saved state using a
+// different one is discarded since its digests can't be reused. cache is
+// optional.
+func loadcompleteState(opts ArchiveOptions, cwd, algo string, cache *HashCache, skipUpdate bool) (CompleteState, error) {
 	// TODO(tandrii): is subdir handling required? I think not any more.
 	// TODO(tandrii): assert absolute path of isolate or isolated.
 	completeState := CompleteState{}
@@ -332,6 +709,12 @@ func loadcompleteState(opts ArchiveOptions, cwd string, skipUpdate bool) (Comple
 	} else {
 		cwd = cwd_new
 	}
+	if opts.Isolate != "" && !filepath.IsAbs(opts.Isolate) {
+		opts.Isolate = filepath.Join(cwd, filepath.FromSlash(opts.Isolate))
+	}
+	if opts.Isolated != "" && !filepath.IsAbs(opts.Isolated) {
+		opts.Isolated = filepath.Join(cwd, filepath.FromSlash(opts.Isolated))
+	}
 	if opts.Isolated != "" {
 		// Load the previous state if it was present. Namely, "foo.isolated.state".
 		// Note: this call doesn't load the .isolate file.
@@ -348,6 +731,14 @@ func loadcompleteState(opts ArchiveOptions, cwd string, skipUpdate bool) (Comple
 			completeState.InitializeDummy(curCwd)
 		}
 	}
+	if completeState.SavedState.Algo != algo {
+		if opts.Isolated != "" && len(completeState.SavedState.Files) != 0 {
+			log.Printf("warning: %s uses %s instead of %s. Discarding saved state",
+				common.IsolatedFileToState(opts.Isolated), completeState.SavedState.Algo, algo)
+			completeState.InitIgnoreSavedState(opts.Isolated)
+		}
+		completeState.SavedState.Algo = algo
+	}
 	isolate := ""
 	if opts.Isolate == "" {
 		if completeState.SavedState.IsolateFile == "" {
@@ -357,22 +748,23 @@ func loadcompleteState(opts ArchiveOptions, cwd string, skipUpdate bool) (Comple
 				isolate = ""
 			}
 		} else {
-			isolate = completeState.SavedState.IsolateFile
+			isolate = completeState.SavedState.isolateFilepath
 		}
 	} else {
 		isolate = opts.Isolate
 		if completeState.SavedState.IsolateFile != "" {
-			if relIsolate, err := filepath.Rel(opts.Isolate,
-				completeState.SavedState.isolatedBasedir); err != nil {
+			if relIsolate, err := filepath.Rel(completeState.SavedState.isolatedBasedir,
+				opts.Isolate); err != nil {
 				return completeState, err
 			} else if relIsolate != completeState.SavedState.IsolateFile {
 				// This happens if the .isolate file was moved for example. In this case,
 				// discard the saved state.
 				log.Printf("warning: --isolated %s != %s as saved in %s. Discarding saved state",
 					relIsolate, completeState.SavedState.IsolateFile,
-					common.IsolatedFileToState(opts.Isolate))
+					common.IsolatedFileToState(opts.Isolated))
 				completeState = CompleteState{}
-				completeState.InitIgnoreSavedState()
+				completeState.InitIgnoreSavedState(opts.Isolated)
+				completeState.SavedState.Algo = algo
 			}
 		}
 	}
@@ -380,42 +772,84 @@ func loadcompleteState(opts ArchiveOptions, cwd string, skipUpdate bool) (Comple
 		if err := completeState.LoadFromIsolate(cwd, isolate, opts); err != nil {
 			return completeState, err
 		}
-		if err := completeState.FilesToMetadata(); err != nil {
+		if err := completeState.FilesToMetadata(cache, opts.MaxConcurrentIO); err != nil {
 			return completeState, err
 		}
 	}
 	return completeState, nil
 }
 
-func isolateTree(tree Tree, chFileAssets chan<- FileAsset) ([]IsolateHash, error) {
-	//return nil, fmt.Errorf("TODO(tandrii)")
-	return []IsolateHash{IsolateHash("test")}, nil
+func isolateTree(tree Tree, algo string, cache *HashCache, chFileAssets chan<- FileAsset) ([]IsolateHash, error) {
+	completeState, err := loadcompleteState(tree.Opts, tree.Cwd, algo, cache, false)
+	if err != nil {
+		return nil, err
+	}
+	// Save the state before archiving and create the .isolated file.
+	if err := completeState.SaveFiles(); err != nil {
+		return nil, err
+	}
+	// Make sure that the .isolated files are in the list of files to archive,
+	// with a high priority, and compute their hash. The first one is the main
+	// .isolated file.
+	isolatedDir := filepath.Dir(completeState.isolatedFilepath)
+	isolatedPaths := []string{completeState.isolatedFilepath}
+	for _, child := range completeState.ChildIsolatedFiles {
+		isolatedPaths = append(isolatedPaths, filepath.Join(isolatedDir, child))
+	}
+	hashes := []IsolateHash{}
+	assets := []FileAsset{}
+	for _, p := range isolatedPaths {
+		h, err := HashFile(p, completeState.Algo)
+		if err != nil {
+			return nil, err
+		}
+		size, err := common.GetFileSize(p)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, IsolateHash(h))
+		assets = append(assets, FileAsset{FileMetadata{Digest: h, Mode: -1, Size: size, HighPriority: true}, p})
+	}
+	for f, meta := range completeState.Files {
+		assets = append(assets, FileAsset{meta, filepath.Join(completeState.RootDir, filepath.FromSlash(f))})
+	}
+	for _, fa := range assets {
+		select {
+		case chFileAssets <- fa:
+		case <-interrupt.Channel:
+			return nil, errors.New("interrupted")
+		}
+	}
+	return hashes, nil
 }
 
-func Isolate(trees []Tree) (map[string]IsolateHash, []FileAsset, error) {
+// Isolate processes the trees and returns the hash of the .isolated file of
+// each of them, keyed by target name, and the files to archive. algo is the
+// hashing algorithm to use, see isolateserver.GetHashAlgo().
+func Isolate(trees []Tree, algo string) (map[string]IsolateHash, []FileAsset, error) {
 	chTrees := make(chan Tree, len(trees))
 	for _, tree := range trees {
 		chTrees <- tree
 	}
 	close(chTrees)
-	chIsolateHashes, chFileAssets, chErrors := IsolateAsync(chTrees)
-	var isolatedHashes map[string]IsolateHash
-	var err error
+	chIsolateHashes, chFileAssets, chErrors := IsolateAsync(chTrees, algo, nil)
 	fileAssets := []FileAsset{}
-	for err == nil {
-		select {
-		case i := <-chIsolateHashes:
-			isolatedHashes = i
-		case fa := <-chFileAssets:
-			fileAssets = append(fileAssets, fa)
-		case e := <-chErrors:
-			err = e
-		}
+	for fa := range chFileAssets {
+		fileAssets = append(fileAssets, fa)
 	}
-	return isolatedHashes, fileAssets, err
+	isolatedHashes := <-chIsolateHashes
+	return isolatedHashes, fileAssets, <-chErrors
 }
 
-func IsolateAsync(trees <-chan Tree) (<-chan map[string]IsolateHash, <-chan FileAsset, <-chan error) {
+// IsolateAsync processes the trees received on trees concurrently.
+//
+// The digests of the files are shared by all the trees through cache, so a
+// file present in several trees is hashed only once. If cache is nil, a new
+// in-memory HashCache is used.
+func IsolateAsync(trees <-chan Tree, algo string, cache *HashCache) (<-chan map[string]IsolateHash, <-chan FileAsset, <-chan error) {
+	if cache == nil {
+		cache = NewHashCache(algo)
+	}
 	type result struct {
 		target string
 		hash   IsolateHash
@@ -427,12 +861,16 @@ func IsolateAsync(trees <-chan Tree) (<-chan map[string]IsolateHash, <-chan File
 		var wg sync.WaitGroup
 		for tree := range trees {
 			wg.Add(1)
-			go func() {
+			go func(tree Tree) {
+				defer wg.Done()
 				targetName := common.GetFileNameWithoutExtension(tree.Opts.Isolated)
-				treeIsolatedHashes, err := isolateTree(tree, chFileAssets)
-				chResults <- result{targetName, treeIsolatedHashes[0], err}
-				wg.Done()
-			}()
+				treeIsolatedHashes, err := isolateTree(tree, algo, cache, chFileAssets)
+				if err != nil {
+					chResults <- result{targetName, "", err}
+					return
+				}
+				chResults <- result{targetName, treeIsolatedHashes[0], nil}
+			}(tree)
 		}
 		wg.Wait()
 		close(chFileAssets)
@@ -445,22 +883,33 @@ func IsolateAsync(trees <-chan Tree) (<-chan map[string]IsolateHash, <-chan File
 		defer close(chError)
 		defer close(chIsolateHashes)
 		isolateHashes := map[string]IsolateHash{}
+		var err error
+		// Keep draining chResults on error so that no tree is left blocked.
 		for r := range chResults {
 			if r.err != nil {
 				// TODO(tandrii): this used to be ignored in Py-swarming.
-				chError <- r.err
-				return
+				if err == nil {
+					err = r.err
+				}
+				continue
 			}
 			isolateHashes[r.target] = r.hash
 		}
+		if err != nil {
+			chError <- err
+			return
+		}
 		chIsolateHashes <- isolateHashes
 		chError <- nil // Indicate success.
 	}()
 	return chIsolateHashes, chFileAssets, chError
 }
 
-//prepareItemsForUpload filters out duplicated FileAsset and converts them to isolateserver.FileItem.
-func prepareItemsForUpload(chIn <-chan FileAsset) <-chan isolateserver.UploadItem {
+// prepareItemsForUpload filters out duplicated FileAsset and converts them to isolateserver.FileItem.
+//
+// Once done is closed, the remaining FileAsset are read and dropped so the
+// senders on chIn don't block.
+func prepareItemsForUpload(done <-chan struct{}, chIn <-chan FileAsset) <-chan isolateserver.UploadItem {
 	chOut := make(chan isolateserver.UploadItem)
 	go func() {
 		defer close(chOut)
@@ -468,11 +917,17 @@ func prepareItemsForUpload(chIn <-chan FileAsset) <-chan isolateserver.UploadIte
 		skipped := 0
 		defer log.Printf("Skipped %d duplicated entries", skipped)
 
+		stopped := false
 		for fa := range chIn {
+			if stopped {
+				continue
+			}
 			if !fa.IsSymlink() && !seen[fa.fullPath] {
 				seen[fa.fullPath] = true
 				select {
 				case chOut <- fa.ToUploadItem():
+				case <-done:
+					stopped = true
 				case <-interrupt.Channel:
 					return
 				}
@@ -484,27 +939,37 @@ func prepareItemsForUpload(chIn <-chan FileAsset) <-chan isolateserver.UploadIte
 	return chOut
 }
 
-func Archive(fileAssets []FileAsset, namespace string, server string) error {
+func Archive(fileAssets []FileAsset, api isolateserver.StorageApi) error {
 	chFileAssets := make(chan FileAsset, len(fileAssets))
 	for _, fa := range fileAssets {
 		chFileAssets <- fa
 	}
 	close(chFileAssets)
-	chErrors := ArchiveAsync(chFileAssets, namespace, server)
+	chErrors := ArchiveAsync(chFileAssets, api)
 	return <-chErrors
 }
 
-func ArchiveAsync(chFileAssets <-chan FileAsset, namespace string, server string) <-chan error {
+// ArchiveAsync uploads the files received on chFileAssets to api, e.g. the
+// StorageApi returned by isolateserver.GetStorageApi.
+//
+// chFileAssets is read until it is closed, even if the upload fails, so the
+// senders never block.
+func ArchiveAsync(chFileAssets <-chan FileAsset, api isolateserver.StorageApi) <-chan error {
 	chError := make(chan error, 1)
 	go func() {
 		defer close(chError)
-		s := isolateserver.NewStorage(server, namespace)
+		// Upload doesn't read the items anymore once it returns, e.g. on error.
+		done := make(chan struct{})
+		defer close(done)
+		chFilesToUpload := prepareItemsForUpload(done, chFileAssets)
+		s := isolateserver.NewStorageWithApi(api)
 		if err := s.Connect(); err != nil {
 			chError <- err
 			return
 		}
-		chFilesToUpload := prepareItemsForUpload(chFileAssets)
-		chError <- s.Upload(chFilesToUpload)
+		stats, err := s.Upload(interrupt.Channel, chFilesToUpload)
+		log.Printf("Upload: %s", stats)
+		chError <- err
 	}()
 	return chError
 }
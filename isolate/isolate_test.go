@@ -5,11 +5,422 @@
 package isolate
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
 )
 
+func TestLoadFromIsolate(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"src/tests/foo.isolate": `{
+  'conditions': [
+    ['OS=="linux"', {
+      'variables': {
+        'command': ['<(PRODUCT_DIR)/foo_test<(EXECUTABLE_SUFFIX)', '--os=<(OS)'],
+        'files': ['<(PRODUCT_DIR)/foo_test', 'data/', '../../tools/run.py'],
+        'read_only': 0,
+      },
+    }],
+  ],
+}`,
+		"src/tests/data/a.txt":     "a",
+		"src/out/Release/foo_test": "foo",
+		"tools/run.py":             "run",
+	})
+	defer os.RemoveAll(dir)
+	cs := CompleteState{}
+	cs.InitializeDummy(dir)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.PathVariables["PRODUCT_DIR"] = "src/out/Release"
+	opts.ExtraVariables["EXECUTABLE_SUFFIX"] = ""
+	opts.ConfigVariables["OS"] = "linux"
+	if err := cs.LoadFromIsolate(dir, filepath.Join(dir, "src", "tests", "foo.isolate"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if cs.RootDir != dir {
+		t.Errorf("expected root dir %s, got %s", dir, cs.RootDir)
+	}
+	if cs.RelativeCwd != "src/tests" {
+		t.Errorf("unexpected relative cwd %s", cs.RelativeCwd)
+	}
+	expectedCommand := []string{"../out/Release/foo_test", "--os=linux"}
+	if !reflect.DeepEqual(expectedCommand, cs.Command) {
+		t.Errorf("expected command %v, got %v", expectedCommand, cs.Command)
+	}
+	if cs.ReadOnly != 0 {
+		t.Errorf("expected read_only 0, got %d", cs.ReadOnly)
+	}
+	files := []string{}
+	for f := range cs.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	expectedFiles := []string{"src/out/Release/foo_test", "src/tests/data/a.txt", "tools/run.py"}
+	if !reflect.DeepEqual(expectedFiles, files) {
+		t.Errorf("expected files %v, got %v", expectedFiles, files)
+	}
+	if !reflect.DeepEqual(KeyVars{"PRODUCT_DIR": "../out/Release"}, cs.PathVariables) {
+		t.Errorf("unexpected path variables %v", cs.PathVariables)
+	}
+	if cs.IsolateFile != "src/tests/foo.isolate" {
+		t.Errorf("unexpected isolate file %s", cs.IsolateFile)
+	}
+}
+
+func TestDetermineRootDir(t *testing.T) {
+	data := []struct {
+		infiles  []string
+		expected string
+	}{
+		{[]string{"a", "b/"}, "/a/b/c"},
+		{[]string{"../x", "y"}, "/a/b"},
+		{[]string{"../x", "../../y/"}, "/a"},
+		{[]string{"foo/../../x"}, "/a/b"},
+	}
+	for _, line := range data {
+		for i, f := range line.infiles {
+			line.infiles[i] = filepath.FromSlash(f)
+		}
+		expected := filepath.FromSlash(line.expected)
+		if actual := determineRootDir(filepath.FromSlash("/a/b/c"), line.infiles); actual != expected {
+			t.Errorf("%v: expected %s, got %s", line.infiles, expected, actual)
+		}
+	}
+}
+
+func TestSavedStateLoad(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{"foo.isolate": "{}"})
+	defer os.RemoveAll(dir)
+	data := []struct {
+		state    string
+		expected string
+	}{
+		{`{"OS":"plan9","algo":"sha-1","version":"1.0"}`, "unexpected OS plan9"},
+		{`{"OS":"` + runtime.GOOS + `","algo":"md4","version":"1.0"}`, "unknown algo 'md4'"},
+		{`{"OS":"` + runtime.GOOS + `","algo":"sha-1","version":"1.1"}`, "unsupported version '1.1'"},
+		{`{"OS":"` + runtime.GOOS + `","algo":"sha-1","version":"1.0","read_only":3}`, "read_only must be 0, 1 or 2, got 3"},
+		{`{"OS":"` + runtime.GOOS + `","algo":"sha-1","version":"1.0","read_only":"1"}`, "invalid read_only"},
+		{`{"OS":"` + runtime.GOOS + `","algo":"sha-1","version":"1.0"}`, ""},
+	}
+	for _, line := range data {
+		ss := SavedState{}
+		err := ss.Load([]byte(line.state), dir)
+		if line.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", line.state, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), line.expected) {
+			t.Errorf("%s: expected error %q, got %v", line.state, line.expected, err)
+		}
+	}
+
+	// read_only is an int, older states saved it as a bool.
+	ss := SavedState{}
+	for state, expected := range map[string]int{`2`: 2, `0`: 0, `true`: 1, `false`: 0, `null`: 1} {
+		data := `{"OS":"` + runtime.GOOS + `","algo":"sha-1","version":"1.0","read_only":` + state + `}`
+		if err := ss.Load([]byte(data), dir); err != nil {
+			t.Fatal(err)
+		}
+		if ss.ReadOnly != expected {
+			t.Errorf("%s: expected read_only %d, got %d", state, expected, ss.ReadOnly)
+		}
+		if *ss.ToIsolated().ReadOnly != expected {
+			t.Errorf("%s: expected read_only %d in the .isolated file", state, expected)
+		}
+	}
+
+	// A missing .isolate file is zapped from the state.
+	ss = SavedState{}
+	state := `{"OS":"` + runtime.GOOS + `","algo":"sha-1","version":"1.0","isolate_file":"%s","files":null}`
+	if err := ss.Load([]byte(strings.Replace(state, "%s", "missing.isolate", 1)), dir); err != nil {
+		t.Fatal(err)
+	}
+	if ss.IsolateFile != "" || ss.Files == nil {
+		t.Errorf("unexpected state %#v", ss)
+	}
+	if err := ss.Load([]byte(strings.Replace(state, "%s", "foo.isolate", 1)), dir); err != nil {
+		t.Fatal(err)
+	}
+	if ss.IsolateFile != "foo.isolate" || ss.isolateFilepath != filepath.Join(dir, "foo.isolate") {
+		t.Errorf("unexpected state %#v", ss)
+	}
+}
+
+func TestCompleteStateSaveFiles(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"a/foo.isolate": "{'variables': {'command': ['foo'], 'files': ['foo.txt']}}",
+		"a/foo.txt":     "foo",
+		"b/bar.isolate": "{'variables': {'command': ['bar'], 'files': ['bar.txt']}}",
+		"b/bar.txt":     "bar",
+	})
+	defer os.RemoveAll(dir)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "a/foo.isolate"
+	opts.Isolated = "out/foo.isolated"
+	opts.ExtraVariables["foo"] = "bar"
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := loadcompleteState(opts, dir, "sha-1", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.SaveFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "out", "foo.isolated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	isolated, err := isolateserver.LoadIsolated(content, "sha-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The root is a/, which is also where the command is run from.
+	if !reflect.DeepEqual([]string{"foo"}, isolated.Command) || isolated.RelativeCwd != "." ||
+		isolated.Files["foo.txt"].Digest != "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33" ||
+		*isolated.Files["foo.txt"].Size != 3 || *isolated.ReadOnly != 1 {
+		t.Errorf("unexpected .isolated %s", content)
+	}
+
+	// The state is reloaded without the .isolate file.
+	loaded := CompleteState{}
+	if err := loaded.LoadFromIsolated(filepath.Join(dir, "out", "foo.isolated")); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsolateFile != filepath.Join("..", "a", "foo.isolate") {
+		t.Errorf("unexpected isolate file %s", loaded.IsolateFile)
+	}
+	if !reflect.DeepEqual(cs.Files, loaded.Files) || len(loaded.Files) != 1 {
+		t.Errorf("expected files %v, got %v", cs.Files, loaded.Files)
+	}
+	if !reflect.DeepEqual(KeyVars{"foo": "bar"}, loaded.ExtraVariables) {
+		t.Errorf("unexpected extra variables %v", loaded.ExtraVariables)
+	}
+	opts.Isolate = ""
+	if cs, err = loadcompleteState(opts, dir, "sha-1", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"foo"}, cs.Command) {
+		t.Errorf("unexpected command %v", cs.Command)
+	}
+
+	// The .isolate file moved, the saved state is discarded.
+	opts.Isolate = "b/bar.isolate"
+	opts.ExtraVariables = KeyVars{}
+	if cs, err = loadcompleteState(opts, dir, "sha-1", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if cs.IsolateFile != filepath.Join("..", "b", "bar.isolate") {
+		t.Errorf("unexpected isolate file %s", cs.IsolateFile)
+	}
+	if len(cs.ExtraVariables) != 0 {
+		t.Errorf("unexpected extra variables %v", cs.ExtraVariables)
+	}
+	if _, ok := cs.Files["bar.txt"]; !ok || len(cs.Files) != 1 {
+		t.Errorf("unexpected files %v", cs.Files)
+	}
+
+	// A dummy state can't be saved.
+	dummy := CompleteState{}
+	dummy.InitializeDummy(dir)
+	if err := dummy.SaveFiles(); err == nil {
+		t.Error("expected an error saving a dummy state")
+	}
+}
+
+func TestIsolate(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"foo.isolate": "{'variables': {'command': ['foo'], 'files': ['foo.txt']}}",
+		"foo.txt":     "foo",
+	})
+	defer os.RemoveAll(dir)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "foo.isolate"
+	opts.Isolated = "foo.isolated"
+	hashes, fileAssets, err := Isolate([]Tree{{dir, opts}}, "sha-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The isolated hash is the hash of the .isolated file.
+	h, err := HashFile(filepath.Join(dir, "foo.isolated"), "sha-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(map[string]IsolateHash{"foo": IsolateHash(h)}, hashes) {
+		t.Errorf("unexpected hashes %v", hashes)
+	}
+	if len(fileAssets) != 2 || !fileAssets[0].IsHighPriority() || fileAssets[0].GetDigest() != h {
+		t.Errorf("unexpected file assets %v", fileAssets)
+	}
+
+	opts.Isolate = "missing.isolate"
+	if _, _, err := Isolate([]Tree{{dir, opts}}, "sha-1"); err == nil {
+		t.Error("expected an error for a missing .isolate file")
+	}
+}
+
+func TestIsolateHashAlgo(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{
+		"foo.isolate": "{'variables': {'files': ['foo.txt']}}",
+		"foo.txt":     "foo",
+	})
+	defer os.RemoveAll(dir)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "foo.isolate"
+	opts.Isolated = "foo.isolated"
+	if _, _, err := Isolate([]Tree{{dir, opts}}, "sha-1"); err != nil {
+		t.Fatal(err)
+	}
+	// The saved state uses sha-1, it is discarded.
+	hashes, _, err := Isolate([]Tree{{dir, opts}}, "sha-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "foo.isolated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	isolated, err := isolateserver.LoadIsolated(content, "sha-256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if isolated.Files["foo.txt"].Digest != expected {
+		t.Errorf("unexpected .isolated %s", content)
+	}
+	if !isolateserver.IsValidHash(string(hashes["foo"]), "sha-256") {
+		t.Errorf("unexpected hash %s", hashes["foo"])
+	}
+	ss := SavedState{}
+	if err := ss.LoadFile(filepath.Join(dir, "foo.isolated.state"), dir); err != nil {
+		t.Fatal(err)
+	}
+	if ss.Algo != "sha-256" || ss.Files["foo.txt"].Digest != expected {
+		t.Errorf("unexpected state %#v", ss)
+	}
+}
+
+func TestFilesToMetadata(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("d%d/f%d", i%5, i)] = strings.Repeat("x", i)
+	}
+	dir := writeIsolates(t, files)
+	defer os.RemoveAll(dir)
+	newState := func() *CompleteState {
+		cs := &CompleteState{}
+		cs.Init(dir)
+		cs.RootDir = dir
+		for f := range files {
+			cs.Files[f] = FileMetadata{Mode: -1}
+		}
+		return cs
+	}
+
+	// The result doesn't depend on the number of workers nor the I/O limit.
+	expected := newState()
+	if err := expected.filesToMetadata(nil, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{2, 8, 64} {
+		for _, maxIO := range []int{0, 1, 3} {
+			cs := newState()
+			if err := cs.filesToMetadata(nil, workers, maxIO); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected.Files, cs.Files) {
+				t.Errorf("%d workers, %d I/O: expected %v, got %v", workers, maxIO, expected.Files, cs.Files)
+			}
+		}
+	}
+
+	// The first error stops the work and leaves the state untouched.
+	cs := newState()
+	cs.Files["missing"] = FileMetadata{Mode: -1}
+	if err := cs.filesToMetadata(nil, 4, 2); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	for f, meta := range cs.Files {
+		if meta.Digest != "" {
+			t.Errorf("%s: expected no digest, got %s", f, meta.Digest)
+		}
+	}
+}
+
+// failingStorageApi fails all the pushes.
+type failingStorageApi struct {
+	*isolateserver.DryLoggingStorageApi
+}
+
+func (f *failingStorageApi) Push(done <-chan struct{}, item isolateserver.UploadItem, pushState isolateserver.PushState) <-chan error {
+	chError := make(chan error, 1)
+	chError <- errors.New("push failed")
+	close(chError)
+	return chError
+}
+
+func TestArchiveFailure(t *testing.T) {
+	files := map[string]string{"foo.isolate": "{'variables': {'files': ['data/']}}"}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("data/f%d", i)] = strings.Repeat("x", i)
+	}
+	dir := writeIsolates(t, files)
+	defer os.RemoveAll(dir)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "foo.isolate"
+	opts.Isolated = "foo.isolated"
+	_, fileAssets, err := Isolate([]Tree{{dir, opts}}, "sha-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &failingStorageApi{isolateserver.NewDryLoggingStorageApi("https://example.com", "default")}
+
+	before := runtime.NumGoroutine()
+	if err := Archive(fileAssets, api); err == nil || !strings.Contains(err.Error(), "push failed") {
+		t.Errorf("expected a push error, got %v", err)
+	}
+	// The senders are not blocked by the failed upload.
+	chFileAssets := make(chan FileAsset)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(chFileAssets)
+		for _, fa := range fileAssets {
+			chFileAssets <- fa
+		}
+	}()
+	if err := <-ArchiveAsync(chFileAssets, api); err == nil {
+		t.Error("expected a push error")
+	}
+	<-sent
+	// Wait for the goroutines to exit.
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("leaked %d goroutines", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func benchmarkHashFile(size int64, b *testing.B) {
 	data := make([]byte, size)
 	filepath := "/dev/shm/ram_please"
@@ -54,3 +465,44 @@ func BenchmarkHashFile100M(b *testing.B) {
 	//	cPython takes about 0.18-0.21, so this is good enough for now.
 	benchmarkHashFile(100*1024*1024, b)
 }
+
+func benchmarkFilesToMetadata(workers, maxConcurrentIO int, b *testing.B) {
+	dir, err := ioutil.TempDir("", "isolate")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, 64*1024)
+	names := []string{}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("f%d", i)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cs := &CompleteState{}
+		cs.Init(dir)
+		cs.RootDir = dir
+		for _, name := range names {
+			cs.Files[name] = FileMetadata{Mode: -1}
+		}
+		if e := cs.filesToMetadata(nil, workers, maxConcurrentIO); e != nil {
+			panic(e)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkFilesToMetadata1Worker(b *testing.B) {
+	benchmarkFilesToMetadata(1, 0, b)
+}
+func BenchmarkFilesToMetadataNumCPU(b *testing.B) {
+	benchmarkFilesToMetadata(runtime.NumCPU(), 0, b)
+}
+func BenchmarkFilesToMetadataNumCPU2IO(b *testing.B) {
+	benchmarkFilesToMetadata(runtime.NumCPU(), 2, b)
+}
@@ -0,0 +1,431 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// textPos is a position in the parsed content. Line and column are 1-based,
+// the column is counted in runes.
+type textPos struct {
+	line   int
+	column int
+}
+
+func (p textPos) String() string {
+	return fmt.Sprintf("line %d, column %d", p.line, p.column)
+}
+
+// literalParser parses the subset of Python syntax used by .isolate files.
+//
+// Only literals are accepted: dicts, lists, tuples, strings, ints, True, False
+// and None. Anything else, e.g. names, calls or operators, is refused, which
+// mirrors what eval_content() achieves in Python by evaluating the content
+// with no builtins available.
+type literalParser struct {
+	content []byte
+	offset  int
+	pos     textPos
+	// positions maps the path of each value, e.g. "conditions/0/0", to the
+	// position where it starts.
+	positions map[string]textPos
+}
+
+// evalContent parses the content of an .isolate file and returns the value
+// defined in it.
+//
+// The returned value is built of map[string]interface{}, []interface{},
+// string, int, bool and nil.
+func evalContent(content []byte) (interface{}, error) {
+	value, _, err := parseLiteral(content)
+	return value, err
+}
+
+// parseLiteral is like evalContent but also returns the position of each
+// value, keyed by its path. The path of the root value is "" and the path of
+// an item is its parent's path, a '/', then its dict key or list index.
+func parseLiteral(content []byte) (interface{}, map[string]textPos, error) {
+	p := literalParser{content: content, pos: textPos{1, 1}, positions: map[string]textPos{}}
+	p.skipSpaces()
+	if p.eof() {
+		return nil, nil, p.errorf("empty content")
+	}
+	value, err := p.parseValue("")
+	if err != nil {
+		return nil, nil, err
+	}
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, nil, p.errorf("unexpected %q after the end of the value", p.peek())
+	}
+	return value, p.positions, nil
+}
+
+func childPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "/" + child
+}
+
+func (p *literalParser) errorf(format string, a ...interface{}) error {
+	return p.errorfAt(p.pos, format, a...)
+}
+
+func (p *literalParser) errorfAt(pos textPos, format string, a ...interface{}) error {
+	return fmt.Errorf("%s: %s", pos, fmt.Sprintf(format, a...))
+}
+
+func (p *literalParser) eof() bool {
+	return p.offset >= len(p.content)
+}
+
+// peek returns the next rune without consuming it.
+func (p *literalParser) peek() rune {
+	if p.eof() {
+		return utf8.RuneError
+	}
+	r, _ := utf8.DecodeRune(p.content[p.offset:])
+	return r
+}
+
+// next consumes and returns the next rune.
+func (p *literalParser) next() rune {
+	r, size := utf8.DecodeRune(p.content[p.offset:])
+	p.offset += size
+	if r == '\n' {
+		p.pos.line++
+		p.pos.column = 1
+	} else {
+		p.pos.column++
+	}
+	return r
+}
+
+// skipSpaces skips whitespace, comments and explicit line continuations.
+func (p *literalParser) skipSpaces() {
+	for !p.eof() {
+		switch r := p.peek(); {
+		case r == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f':
+			p.next()
+		case r == '\\' && p.offset+1 < len(p.content) && p.content[p.offset+1] == '\n':
+			p.next()
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func (p *literalParser) expect(r rune) error {
+	p.skipSpaces()
+	if p.eof() {
+		return p.errorf("expected %q, got end of content", r)
+	}
+	if got := p.peek(); got != r {
+		return p.errorf("expected %q, got %q", r, got)
+	}
+	p.next()
+	return nil
+}
+
+func (p *literalParser) parseValue(path string) (interface{}, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf("unexpected end of content")
+	}
+	p.positions[path] = p.pos
+	switch r := p.peek(); {
+	case r == '{':
+		return p.parseDict(path)
+	case r == '[':
+		return p.parseSequence(path, '[', ']')
+	case r == '(':
+		return p.parseSequence(path, '(', ')')
+	case r == '\'' || r == '"':
+		return p.parseStrings()
+	case r == '-' || r == '+' || (r >= '0' && r <= '9'):
+		return p.parseInt()
+	case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+		return p.parseName()
+	default:
+		return nil, p.errorf("unexpected %q", r)
+	}
+}
+
+func (p *literalParser) parseDict(path string) (interface{}, error) {
+	start := p.pos
+	p.next()
+	out := map[string]interface{}{}
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			return nil, p.errorfAt(start, "unterminated dict")
+		}
+		if p.peek() == '}' {
+			p.next()
+			return out, nil
+		}
+		keyPos := p.pos
+		key, err := p.parseValue(childPath(path, ":key"))
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, p.errorfAt(keyPos, "dict keys must be strings, got %#v", key)
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		if out[k], err = p.parseValue(childPath(path, k)); err != nil {
+			return nil, err
+		}
+		if done, err := p.parseSeparator('}'); err != nil || done {
+			return out, err
+		}
+	}
+}
+
+// parseSequence parses a list or a tuple. Both are returned as []interface{}
+// since they are equivalent as far as .isolate files are concerned.
+func (p *literalParser) parseSequence(path string, open, close rune) (interface{}, error) {
+	start := p.pos
+	p.next()
+	out := []interface{}{}
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			return nil, p.errorfAt(start, "unterminated %c", open)
+		}
+		if p.peek() == close {
+			p.next()
+			return out, nil
+		}
+		item, err := p.parseValue(childPath(path, strconv.Itoa(len(out))))
+		if err != nil {
+			return nil, err
+		}
+		if open == '(' && len(out) == 0 {
+			// A parenthesized value without a comma is not a tuple.
+			p.skipSpaces()
+			if p.peek() == ')' {
+				p.next()
+				return item, nil
+			}
+		}
+		out = append(out, item)
+		if done, err := p.parseSeparator(close); err != nil || done {
+			return out, err
+		}
+	}
+}
+
+// parseSeparator consumes either a ',' or the closing delimiter. It returns
+// true when the closing delimiter was found. Trailing commas are allowed.
+func (p *literalParser) parseSeparator(close rune) (bool, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return false, p.errorf("expected ',' or %q, got end of content", close)
+	}
+	switch r := p.peek(); r {
+	case ',':
+		p.next()
+		return false, nil
+	case close:
+		p.next()
+		return true, nil
+	default:
+		return false, p.errorf("expected ',' or %q, got %q", close, r)
+	}
+}
+
+// parseStrings parses one or more adjacent string literals, which Python
+// implicitly concatenates.
+func (p *literalParser) parseStrings() (interface{}, error) {
+	parts := []string{}
+	for {
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, s)
+		p.skipSpaces()
+		if r := p.peek(); p.eof() || (r != '\'' && r != '"' && !p.atStringPrefix()) {
+			return strings.Join(parts, ""), nil
+		}
+	}
+}
+
+// atStringPrefix returns true if the parser is at a string prefixed with r, u
+// or b.
+func (p *literalParser) atStringPrefix() bool {
+	i := p.offset
+	for i < len(p.content) && i-p.offset < 2 && strings.IndexByte("rRuUbB", p.content[i]) != -1 {
+		i++
+	}
+	return i > p.offset && i < len(p.content) && (p.content[i] == '\'' || p.content[i] == '"')
+}
+
+func (p *literalParser) parseString() (string, error) {
+	start := p.pos
+	raw := false
+	for strings.ContainsRune("rRuUbB", p.peek()) {
+		if r := p.next(); r == 'r' || r == 'R' {
+			raw = true
+		}
+	}
+	quote := p.next()
+	triple := false
+	if p.offset+1 < len(p.content) && rune(p.content[p.offset]) == quote && rune(p.content[p.offset+1]) == quote {
+		p.next()
+		p.next()
+		triple = true
+	} else if p.peek() == quote {
+		p.next()
+		return "", nil
+	}
+	var out []byte
+	for {
+		if p.eof() {
+			return "", p.errorfAt(start, "unterminated string")
+		}
+		r := p.next()
+		switch {
+		case r == quote:
+			if !triple {
+				return string(out), nil
+			}
+			if p.offset+1 < len(p.content) && rune(p.content[p.offset]) == quote && rune(p.content[p.offset+1]) == quote {
+				p.next()
+				p.next()
+				return string(out), nil
+			}
+			out = append(out, byte(r))
+		case r == '\n' && !triple:
+			return "", p.errorfAt(start, "unterminated string")
+		case r == '\\':
+			if p.eof() {
+				return "", p.errorfAt(start, "unterminated string")
+			}
+			if raw {
+				out = append(out, '\\')
+				out = utf8.AppendRune(out, p.next())
+				continue
+			}
+			escaped, err := p.parseEscape()
+			if err != nil {
+				return "", err
+			}
+			out = append(out, escaped...)
+		default:
+			out = utf8.AppendRune(out, r)
+		}
+	}
+}
+
+// parseEscape decodes the escape sequence following a backslash. Unknown
+// escape sequences are kept verbatim, as Python does.
+func (p *literalParser) parseEscape() ([]byte, error) {
+	pos := p.pos
+	r := p.next()
+	switch r {
+	case '\n':
+		return nil, nil
+	case '\\', '\'', '"':
+		return []byte{byte(r)}, nil
+	case 'a':
+		return []byte{'\a'}, nil
+	case 'b':
+		return []byte{'\b'}, nil
+	case 'f':
+		return []byte{'\f'}, nil
+	case 'n':
+		return []byte{'\n'}, nil
+	case 'r':
+		return []byte{'\r'}, nil
+	case 't':
+		return []byte{'\t'}, nil
+	case 'v':
+		return []byte{'\v'}, nil
+	case 'x':
+		if p.offset+2 > len(p.content) {
+			return nil, p.errorfAt(pos, "invalid \\x escape")
+		}
+		v, err := strconv.ParseUint(string(p.content[p.offset:p.offset+2]), 16, 8)
+		if err != nil {
+			return nil, p.errorfAt(pos, "invalid \\x escape")
+		}
+		p.next()
+		p.next()
+		return []byte{byte(v)}, nil
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		v := int(r - '0')
+		for i := 0; i < 2 && p.peek() >= '0' && p.peek() <= '7'; i++ {
+			v = v*8 + int(p.next()-'0')
+		}
+		return []byte{byte(v)}, nil
+	default:
+		return utf8.AppendRune([]byte{'\\'}, r), nil
+	}
+}
+
+func (p *literalParser) parseInt() (interface{}, error) {
+	start := p.pos
+	begin := p.offset
+	if r := p.peek(); r == '-' || r == '+' {
+		p.next()
+		p.skipSpaces()
+	}
+	digits := p.offset
+	for !p.eof() && p.peek() >= '0' && p.peek() <= '9' {
+		p.next()
+	}
+	if p.offset == digits {
+		return nil, p.errorfAt(start, "expected a number")
+	}
+	if r := p.peek(); r == '.' || r == 'e' || r == 'E' || r == 'x' || r == 'X' || r == 'l' || r == 'L' {
+		return nil, p.errorfAt(start, "only decimal integers are supported")
+	}
+	text := strings.Replace(string(p.content[begin:p.offset]), " ", "", -1)
+	v, err := strconv.Atoi(text)
+	if err != nil {
+		return nil, p.errorfAt(start, "invalid integer %q", text)
+	}
+	return v, nil
+}
+
+func (p *literalParser) parseName() (interface{}, error) {
+	start := p.pos
+	if p.atStringPrefix() {
+		return p.parseStrings()
+	}
+	begin := p.offset
+	for !p.eof() {
+		r := p.peek()
+		if r != '_' && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			break
+		}
+		p.next()
+	}
+	switch name := string(p.content[begin:p.offset]); name {
+	case "True":
+		return true, nil
+	case "False":
+		return false, nil
+	case "None":
+		return nil, nil
+	default:
+		return nil, p.errorfAt(start, "only literals are allowed, got name %q", name)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvalContent(t *testing.T) {
+	data := []struct {
+		content  string
+		expected interface{}
+	}{
+		{`{}`, map[string]interface{}{}},
+		{`[]`, []interface{}{}},
+		{`{'a': 1, "b": [True, False, None,],}`,
+			map[string]interface{}{"a": 1, "b": []interface{}{true, false, nil}}},
+		{"# comment\n{\n  'a': -2,  # trailing\n}\n", map[string]interface{}{"a": -2}},
+		{`'a' "b"`, "ab"},
+		{`'\'\\\n\x41\101\d'`, "'\\\nAA\\d"},
+		{`r'\n'`, `\n`},
+		{`u'é'`, `é`},
+		{`"""a'b"c"""`, `a'b"c`},
+		{`('a', 'b')`, []interface{}{"a", "b"}},
+		{`('a')`, "a"},
+		{"'é'", "é"},
+	}
+	for _, line := range data {
+		actual, err := evalContent([]byte(line.content))
+		if err != nil {
+			t.Errorf("%s: %s", line.content, err)
+		} else if !reflect.DeepEqual(line.expected, actual) {
+			t.Errorf("%s: expected %#v, got %#v", line.content, line.expected, actual)
+		}
+	}
+}
+
+func TestEvalContentRefused(t *testing.T) {
+	data := []struct {
+		content string
+		err     string
+	}{
+		{``, "line 1, column 1: empty content"},
+		{`{'a': open('/etc/passwd')}`, "line 1, column 7: only literals are allowed"},
+		{"{\n  'a': 1 + 2}", "line 2, column 10: expected ',' or '}'"},
+		{`__import__('os')`, "only literals are allowed"},
+		{`{1: 2}`, "dict keys must be strings"},
+		{`{'a': 1.5}`, "only decimal integers"},
+		{`{'a': 1} {}`, "after the end of the value"},
+		{"{'a': 'b}", "line 1, column 7: unterminated string"},
+		{"{'a': 'b'", "got end of content"},
+		{"{'a': 'b',", "unterminated dict"},
+	}
+	for _, line := range data {
+		_, err := evalContent([]byte(line.content))
+		if err == nil || !strings.Contains(err.Error(), line.err) {
+			t.Errorf("%s: expected error %q, got %v", line.content, line.err, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+)
+
+// FileMetadata is the meta data about a file, as saved in the 'files' section
+// of the .isolated.state file.
+type FileMetadata struct {
+	// Digest is the hash of the file content. It is empty for symlinks and for
+	// files that were not hashed yet.
+	Digest string
+	// Link is the destination of the symlink, if the file is a symlink.
+	Link string
+	// Mode is the file mode, or -1 if not set. It is not set on Windows and for
+	// symlinks.
+	Mode int
+	// Size is the size of the file in bytes. It is not used for symlinks.
+	Size int64
+	// Timestamp is the modification time of the file, in seconds since epoch.
+	// It is used to skip recalculating the hash or link destination.
+	Timestamp int64
+	// HighPriority is set for the items that must be uploaded first, i.e. the
+	// .isolated files. It is not saved.
+	HighPriority bool
+}
+
+// fileMetadataJSON is the JSON representation of FileMetadata. The keys are
+// the same as the ones used in .isolated files, with 't' being the timestamp.
+type fileMetadataJSON struct {
+	Digest    string          `json:"h,omitempty"`
+	Link      string          `json:"l,omitempty"`
+	Mode      json.RawMessage `json:"m,omitempty"`
+	Size      json.RawMessage `json:"s,omitempty"`
+	Timestamp json.RawMessage `json:"t,omitempty"`
+}
+
+func (m *FileMetadata) IsSymlink() bool {
+	return m.Link != ""
+}
+
+func (m *FileMetadata) IsHighPriority() bool {
+	return m.HighPriority
+}
+
+func (m *FileMetadata) GetDigest() string {
+	return m.Digest
+}
+
+func (m *FileMetadata) GetSize() int64 {
+	return m.Size
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m FileMetadata) MarshalJSON() ([]byte, error) {
+	out := fileMetadataJSON{Digest: m.Digest, Link: m.Link}
+	if !m.IsSymlink() {
+		if m.Mode != -1 {
+			out.Mode = json.RawMessage(strconv.Itoa(m.Mode))
+		}
+		out.Size = json.RawMessage(strconv.FormatInt(m.Size, 10))
+	}
+	out.Timestamp = json.RawMessage(strconv.FormatInt(m.Timestamp, 10))
+	return json.Marshal(&out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// State files written by older versions stored 'm', 's' and 't' as strings,
+// some of them corrupted. Decimal strings are accepted; if any of the values
+// can't be decoded, the cached digest and link are dropped so they are
+// calculated again.
+func (m *FileMetadata) UnmarshalJSON(data []byte) error {
+	in := fileMetadataJSON{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*m = FileMetadata{Digest: in.Digest, Link: in.Link, Mode: -1}
+	valid := true
+	if in.Mode != nil {
+		mode, ok := decodeLegacyInt(in.Mode)
+		m.Mode = int(mode)
+		valid = valid && ok
+	}
+	if in.Size != nil {
+		size, ok := decodeLegacyInt(in.Size)
+		m.Size = size
+		valid = valid && ok
+	}
+	if in.Timestamp != nil {
+		timestamp, ok := decodeLegacyInt(in.Timestamp)
+		m.Timestamp = timestamp
+		valid = valid && ok
+	}
+	if !valid {
+		*m = FileMetadata{Mode: -1}
+	}
+	return nil
+}
+
+// decodeLegacyInt decodes a JSON int, or a string containing a decimal int.
+func decodeLegacyInt(data json.RawMessage) (int64, bool) {
+	var i int64
+	if err := json.Unmarshal(data, &i); err == nil {
+		return i, true
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	return i, err == nil
+}
+
+// toIsolatedFile returns the entry in the 'files' section of an .isolated
+// file, keeping only the whitelisted keys.
+func (m *FileMetadata) toIsolatedFile() isolateserver.IsolatedFile {
+	out := isolateserver.IsolatedFile{Digest: m.Digest}
+	if m.IsSymlink() {
+		link := m.Link
+		out.Link = &link
+		return out
+	}
+	if m.Mode != -1 {
+		mode := m.Mode
+		out.Mode = &mode
+	}
+	size := m.Size
+	out.Size = &size
+	return out
+}
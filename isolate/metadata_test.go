@@ -0,0 +1,147 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileMetadataJSON(t *testing.T) {
+	h := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+	data := []struct {
+		meta     FileMetadata
+		expected string
+	}{
+		{FileMetadata{Digest: h, Mode: 0640, Size: 3, Timestamp: 1400000000}, `{"h":"` + h + `","m":416,"s":3,"t":1400000000}`},
+		{FileMetadata{Digest: h, Mode: -1, Size: 0, Timestamp: 1}, `{"h":"` + h + `","s":0,"t":1}`},
+		{FileMetadata{Link: "../a", Mode: -1, Timestamp: 1}, `{"l":"../a","t":1}`},
+	}
+	for _, line := range data {
+		out, err := json.Marshal(line.meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != line.expected {
+			t.Errorf("expected %s, got %s", line.expected, out)
+		}
+		meta := FileMetadata{}
+		if err := json.Unmarshal(out, &meta); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(line.meta, meta) {
+			t.Errorf("expected %#v, got %#v", line.meta, meta)
+		}
+	}
+}
+
+func TestFileMetadataLegacyJSON(t *testing.T) {
+	h := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+	data := []struct {
+		input    string
+		expected FileMetadata
+	}{
+		// Decimal strings are migrated.
+		{`{"h":"` + h + `","m":"416","s":"3","t":"1400000000"}`, FileMetadata{Digest: h, Mode: 0640, Size: 3, Timestamp: 1400000000}},
+		// Ints encoded as runes are dropped along the cached digest.
+		{`{"h":"` + h + `","m":"Ơ","t":"\u0001"}`, FileMetadata{Mode: -1}},
+		{`{"l":"a","t":"\u0001"}`, FileMetadata{Mode: -1}},
+	}
+	for _, line := range data {
+		meta := FileMetadata{}
+		if err := json.Unmarshal([]byte(line.input), &meta); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(line.expected, meta) {
+			t.Errorf("%s: expected %#v, got %#v", line.input, line.expected, meta)
+		}
+	}
+}
+
+func TestFileToMetadata(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{"foo": "foo"})
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "foo")
+	if err := os.Chmod(p, 0750); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := FileToMetadata(p, FileMetadata{Mode: -1}, 1, "sha-1", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := FileMetadata{
+		Digest:    "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		Mode:      0550,
+		Size:      3,
+		Timestamp: (fi.ModTime().UnixNano() + 5e8) / 1e9,
+	}
+	if !reflect.DeepEqual(expected, meta) {
+		t.Errorf("expected %#v, got %#v", expected, meta)
+	}
+
+	// The cached digest is reused when the timestamp and size didn't change.
+	prev := meta
+	prev.Digest = "cached"
+	if meta, err = FileToMetadata(p, prev, 1, "sha-1", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Digest != "cached" {
+		t.Errorf("expected the cached digest to be used, got %s", meta.Digest)
+	}
+	// The file stays writable with read_only 0, for both 1 and 2 only the
+	// write bit of the user is removed.
+	for readOnly, mode := range map[int]int{0: 0750, 1: 0550, 2: 0550} {
+		if meta, err = FileToMetadata(p, prev, readOnly, "sha-1", nil, false); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Mode != mode {
+			t.Errorf("read_only %d: expected mode %o, got %o", readOnly, mode, meta.Mode)
+		}
+	}
+	prev.Size = 4
+	if meta, err = FileToMetadata(p, prev, 1, "sha-1", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Digest != expected.Digest {
+		t.Errorf("expected the digest to be recalculated, got %s", meta.Digest)
+	}
+}
+
+func TestFileToMetadataSymlink(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{"a/foo": "foo"})
+	defer os.RemoveAll(dir)
+	if err := os.Symlink("a/foo", filepath.Join(dir, "rel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "a", "foo"), filepath.Join(dir, "a", "abs")); err != nil {
+		t.Fatal(err)
+	}
+	// Links are relative to the directory containing them.
+	for name, expected := range map[string]string{"rel": "a/foo", "a/abs": "foo"} {
+		meta, err := FileToMetadata(filepath.Join(dir, filepath.FromSlash(name)), FileMetadata{Mode: -1}, 1, "sha-1", nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Link != expected || meta.Digest != "" || meta.Mode != -1 {
+			t.Errorf("%s: expected link %s, got %#v", name, expected, meta)
+		}
+	}
+
+	// The target is used when collapsing symlinks.
+	meta, err := FileToMetadata(filepath.Join(dir, "rel"), FileMetadata{Mode: -1}, 1, "sha-1", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Link != "" || meta.Digest != "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33" || meta.Size != 3 {
+		t.Errorf("unexpected metadata %#v", meta)
+	}
+}
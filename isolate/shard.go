@@ -0,0 +1,70 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"sort"
+	"strings"
+
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+)
+
+// ISOLATED_MAX_FILES is the number of entries in 'files' above which an
+// .isolated file is split into child .isolated files.
+const ISOLATED_MAX_FILES = 10000
+
+// shardIsolated moves the entries of isolated.Files into child .isolated
+// files when there are more than maxFiles of them, and returns the children.
+//
+// Entries are grouped by top-level directory; small directories are packed
+// together and a directory with more than maxFiles entries is split. Files at
+// the root stay in isolated unless they are too many. The result only depends
+// on the file names, so the same tree always results in the same children.
+//
+// This slightly increases the cold cache cost but greatly reduces the cost of
+// downloading and parsing the main .isolated file.
+func shardIsolated(isolated *isolateserver.Isolated, maxFiles int) []*isolateserver.Isolated {
+	if len(isolated.Files) <= maxFiles {
+		return nil
+	}
+	groups := map[string][]string{}
+	for f := range isolated.Files {
+		dir := ""
+		if i := strings.IndexByte(f, '/'); i != -1 {
+			dir = f[:i]
+		}
+		groups[dir] = append(groups[dir], f)
+	}
+	if len(groups[""]) <= maxFiles {
+		delete(groups, "")
+	}
+	names := make([]string, 0, len(groups))
+	for name, files := range groups {
+		names = append(names, name)
+		sort.Strings(files)
+	}
+	sort.Strings(names)
+
+	children := []*isolateserver.Isolated{}
+	var current *isolateserver.Isolated
+	for _, name := range names {
+		files := groups[name]
+		if current != nil && len(current.Files)+len(files) > maxFiles {
+			current = nil
+		}
+		for _, f := range files {
+			if current == nil {
+				current = isolateserver.NewIsolated(isolated.Algo)
+				children = append(children, current)
+			}
+			current.Files[f] = isolated.Files[f]
+			delete(isolated.Files, f)
+			if len(current.Files) == maxFiles {
+				current = nil
+			}
+		}
+	}
+	return children
+}
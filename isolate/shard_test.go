@@ -0,0 +1,63 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"chromium.googlesource.com/infra/swarming/client-go/isolateserver"
+)
+
+func isolatedFileNames(i *isolateserver.Isolated) []string {
+	out := []string{}
+	for f := range i.Files {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestShardIsolated(t *testing.T) {
+	newIsolated := func(files ...string) *isolateserver.Isolated {
+		i := isolateserver.NewIsolated("sha-1")
+		for _, f := range files {
+			i.Files[f] = isolateserver.IsolatedFile{Digest: f}
+		}
+		return i
+	}
+
+	// Small enough, nothing is split.
+	isolated := newIsolated("a/1", "b/1", "c")
+	if children := shardIsolated(isolated, 3); len(children) != 0 || len(isolated.Files) != 3 {
+		t.Errorf("unexpected split %v", children)
+	}
+
+	isolated = newIsolated("a/1", "a/2", "b/1", "c/1", "c/2", "c/3", "c/4", "root1", "root2")
+	children := shardIsolated(isolated, 3)
+	expected := [][]string{{"a/1", "a/2", "b/1"}, {"c/1", "c/2", "c/3"}, {"c/4"}}
+	if len(children) != len(expected) {
+		t.Fatalf("expected %d children, got %d", len(expected), len(children))
+	}
+	for i, child := range children {
+		if names := isolatedFileNames(child); !reflect.DeepEqual(expected[i], names) {
+			t.Errorf("child %d: expected %v, got %v", i, expected[i], names)
+		}
+		if child.Files[expected[i][0]].Digest != expected[i][0] || child.Algo != "sha-1" || child.Command != nil {
+			t.Errorf("child %d: unexpected %#v", i, child)
+		}
+	}
+	if names := isolatedFileNames(isolated); !reflect.DeepEqual([]string{"root1", "root2"}, names) {
+		t.Errorf("unexpected files left %v", names)
+	}
+
+	// Too many files at the root are split too.
+	isolated = newIsolated("r1", "r2", "r3", "a/1")
+	children = shardIsolated(isolated, 2)
+	if len(children) != 2 || len(isolated.Files) != 0 {
+		t.Errorf("unexpected split %v, %v", children, isolated.Files)
+	}
+}
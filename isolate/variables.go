@@ -0,0 +1,129 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
+)
+import . "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+
+var variableMatcher = regexp.MustCompile(`<\((` + VALID_VARIABLE + `)\)`)
+
+// variableSubstitutor replaces the <(VAR) references found in the command and
+// the files of an .isolate file.
+//
+// The semantics are the same as in Python isolate:
+//   - path variables are relative to the .isolate directory, see
+//     normalizePathVariables, and are replaced in both the command and files;
+//   - extra variables are replaced verbatim in both the command and files;
+//   - config variables are only replaced in the command.
+type variableSubstitutor struct {
+	// isolateFile is only used to report errors.
+	isolateFile     string
+	pathVariables   KeyVars
+	extraVariables  KeyVars
+	configVariables KeyVars
+}
+
+// command returns a copy of command with the variables replaced.
+func (s *variableSubstitutor) command(command []string) ([]string, error) {
+	variables := mergeVariables(s.pathVariables, s.configVariables, s.extraVariables)
+	out := make([]string, len(command))
+	for i, c := range command {
+		var err error
+		if out[i], err = s.eval(c, "command", variables); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// files returns a copy of files with the variables replaced.
+func (s *variableSubstitutor) files(files []string) ([]string, error) {
+	variables := mergeVariables(s.pathVariables, s.extraVariables)
+	out := make([]string, len(files))
+	for i, f := range files {
+		var err error
+		if out[i], err = s.eval(f, "files", variables); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// eval replaces the variables in item, which comes from the section of the
+// .isolate file.
+func (s *variableSubstitutor) eval(item, section string, variables KeyVars) (string, error) {
+	var err error
+	out := variableMatcher.ReplaceAllStringFunc(item, func(m string) string {
+		name := variableMatcher.FindStringSubmatch(m)[1]
+		value, ok := variables[name]
+		if !ok && err == nil {
+			err = s.unknownVariable(name, item, section, variables)
+		}
+		return value
+	})
+	return out, err
+}
+
+func (s *variableSubstitutor) unknownVariable(name, item, section string, variables KeyVars) error {
+	hint := "did you forget to specify -path-variable, -extra-variable or -config-variable?"
+	if _, ok := s.configVariables[name]; ok {
+		hint = "config variables are only replaced in 'command'"
+	}
+	known := make([]string, 0, len(variables))
+	for k := range variables {
+		known = append(known, k)
+	}
+	sort.Strings(known)
+	return fmt.Errorf("%s: variable %s in %s item %q is not defined; known variables are [%s]; %s",
+		s.isolateFile, name, section, item, strings.Join(known, ", "), hint)
+}
+
+// normalizePathVariables processes path variables as a special case and
+// returns a copy of them.
+//
+// For each path variable: first normalizes it based on cwd, verifies it exists
+// then sets it as relative to relativeBaseDir, the directory of the .isolate
+// file.
+func normalizePathVariables(cwd string, pathVariables KeyVars, relativeBaseDir string) (KeyVars, error) {
+	out := KeyVars{}
+	for k, v := range pathVariables {
+		// Variables could contain / or \ on windows. Always normalize to the
+		// native separator.
+		v = filepath.FromSlash(strings.TrimSpace(v))
+		normalized := filepath.Join(cwd, v)
+		if filepath.IsAbs(v) {
+			normalized = filepath.Clean(v)
+		}
+		if !common.IsDirectory(normalized) {
+			return nil, fmt.Errorf("path variable %s=%s is not a directory", k, normalized)
+		}
+		// All variables are relative to the .isolate file.
+		rel, err := filepath.Rel(relativeBaseDir, normalized)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = rel
+	}
+	return out, nil
+}
+
+// mergeVariables returns the union of vars. Later ones take precedence.
+func mergeVariables(vars ...KeyVars) KeyVars {
+	out := KeyVars{}
+	for _, v := range vars {
+		for key, value := range v {
+			out[key] = value
+		}
+	}
+	return out
+}
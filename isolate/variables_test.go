@@ -0,0 +1,84 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+)
+
+func TestVariableSubstitutor(t *testing.T) {
+	s := variableSubstitutor{
+		"/src/foo.isolate",
+		KeyVars{"PRODUCT_DIR": "../out/Release"},
+		KeyVars{"EXECUTABLE_SUFFIX": ".exe", "version": "<(OS)"},
+		KeyVars{"OS": "win", "chromeos": "0"},
+	}
+	command, err := s.command([]string{"<(PRODUCT_DIR)/foo<(EXECUTABLE_SUFFIX)", "--os=<(OS)", "<(version)", "<(NOT VALID)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"../out/Release/foo.exe", "--os=win", "<(OS)", "<(NOT VALID)"}
+	if !reflect.DeepEqual(expected, command) {
+		t.Errorf("expected %v, got %v", expected, command)
+	}
+	files, err := s.files([]string{"<(PRODUCT_DIR)/", "a<(EXECUTABLE_SUFFIX)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"../out/Release/", "a.exe"}
+	if !reflect.DeepEqual(expected, files) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
+
+func TestVariableSubstitutorErrors(t *testing.T) {
+	s := variableSubstitutor{"/src/foo.isolate", KeyVars{"DEPTH": ".."}, KeyVars{}, KeyVars{"OS": "linux"}}
+	_, err := s.command([]string{"<(PRODUCT_DIR)/foo"})
+	expected := `/src/foo.isolate: variable PRODUCT_DIR in command item "<(PRODUCT_DIR)/foo" is not defined; ` +
+		`known variables are [DEPTH, OS]; did you forget to specify -path-variable, -extra-variable or -config-variable?`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	_, err = s.files([]string{"<(OS)/foo"})
+	if err == nil || !strings.Contains(err.Error(), "variable OS in files item") ||
+		!strings.Contains(err.Error(), "config variables are only replaced in 'command'") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNormalizePathVariables(t *testing.T) {
+	dir := writeIsolates(t, map[string]string{"src/out/Release/foo": ""})
+	defer os.RemoveAll(dir)
+	vars, err := normalizePathVariables(dir, KeyVars{"PRODUCT_DIR": " src/out/Release "}, filepath.Join(dir, "src", "tests"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := KeyVars{"PRODUCT_DIR": filepath.Join("..", "out", "Release")}
+	if !reflect.DeepEqual(expected, vars) {
+		t.Errorf("expected %v, got %v", expected, vars)
+	}
+	if _, err := normalizePathVariables(dir, KeyVars{"DEPTH": "nope"}, dir); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestIsValidVariable(t *testing.T) {
+	for _, v := range []string{"OS", "PRODUCT_DIR", "_a1"} {
+		if !IsValidVariable(v) {
+			t.Errorf("%s should be valid", v)
+		}
+	}
+	for _, v := range []string{"", "1a", "a-b", "a b"} {
+		if IsValidVariable(v) {
+			t.Errorf("%s should be invalid", v)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// CanonicalJSON encodes v the way the Python client encodes .isolated files,
+// i.e. json.dumps(v, sort_keys=True, separators=(',',':')):
+//   - keys are sorted,
+//   - there is no insignificant whitespace,
+//   - non-ASCII characters are escaped as \u sequences, like ensure_ascii,
+//   - numbers are formatted like Python: integers as decimal, floats with
+//     repr().
+//
+// The same value always results in the same bytes, so the hash of the
+// encoding is stable.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalize(data)
+}
+
+// Canonicalize re-encodes the content of an existing .isolated file as
+// canonical JSON. It returns true if content was already canonical.
+func Canonicalize(content []byte) ([]byte, bool, error) {
+	if _, err := LoadIsolated(content, ""); err != nil {
+		return nil, false, err
+	}
+	out, err := canonicalize(content)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, bytes.Equal(out, content), nil
+}
+
+// canonicalize decodes JSON data and re-encodes it canonically.
+func canonicalize(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	buf := &bytes.Buffer{}
+	if err := encodeCanonical(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		s, err := formatNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	case string:
+		encodeString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			encodeString(buf, k)
+			buf.WriteByte(':')
+			if err := encodeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected type %T", v)
+	}
+	return nil
+}
+
+// encodeString escapes s like Python's json module with ensure_ascii.
+func encodeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"':
+			buf.WriteString(`\"`)
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r >= 0x20 && r < 0x7f:
+			buf.WriteByte(byte(r))
+		default:
+			units := []rune{r}
+			if r > 0xffff {
+				r1, r2 := utf16.EncodeRune(r)
+				units = []rune{r1, r2}
+			}
+			for _, u := range units {
+				fmt.Fprintf(buf, "\\u%04x", u)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// formatNumber formats n like Python does: integers in decimal and floats
+// with repr().
+func formatNumber(n json.Number) (string, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+		// Python has arbitrary precision integers, keep the digits as is.
+		return s, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid number %s", s)
+	}
+	return formatFloat(f), nil
+}
+
+// formatFloat formats f like Python's repr(): the shortest representation
+// that round-trips, in fixed notation when the exponent is in [-4, 16) and
+// with a 2 digits exponent otherwise.
+func formatFloat(f float64) string {
+	// Get the shortest digits and the exponent.
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp := e, 0
+	if i := strings.IndexByte(e, 'e'); i != -1 {
+		mantissa = e[:i]
+		exp, _ = strconv.Atoi(e[i+1:])
+	}
+	if exp < -4 || exp >= 16 {
+		sign := "+"
+		if exp < 0 {
+			sign = "-"
+			exp = -exp
+		}
+		return fmt.Sprintf("%se%s%02d", mantissa, sign, exp)
+	}
+	out := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.ContainsRune(out, '.') {
+		out += ".0"
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	// The expectations are the output of
+	// json.dumps(v, sort_keys=True, separators=(',',':')) in Python.
+	data := []struct {
+		input    string
+		expected string
+	}{
+		{`1.0`, `1.0`},
+		{`1e2`, `100.0`},
+		{`1e16`, `1e+16`},
+		{`1.5e-5`, `1.5e-05`},
+		{`0.0001`, `0.0001`},
+		{`1234567.0`, `1234567.0`},
+		{`-0.0`, `-0.0`},
+		{`-0`, `0`},
+		{`1E22`, `1e+22`},
+		{`123456789012345678.0`, `1.2345678901234568e+17`},
+		{`12345678901234567890`, `12345678901234567890`},
+		{` { "b" : "\u0001\u007f\b\f\u2028\"\\\/" , "a" : [ true , null , 1 ] } `,
+			`{"a":[true,null,1],"b":"\u0001\u007f\b\f\u2028\"\\/"}`},
+		{`"über<&>😀"`, `"\u00fcber<&>\ud83d\ude00"`},
+	}
+	for _, line := range data {
+		out, err := canonicalize([]byte(line.input))
+		if err != nil {
+			t.Errorf("%s: %s", line.input, err)
+		} else if string(out) != line.expected {
+			t.Errorf("%s: expected %s, got %s", line.input, line.expected, out)
+		}
+	}
+
+	out, err := CanonicalJSON(map[string]interface{}{"z": 1, "a": []string{"\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"a":["\n"],"z":1}`; string(out) != expected {
+		t.Errorf("expected %s, got %s", expected, out)
+	}
+
+	if _, err := canonicalize([]byte(`{} {}`)); err == nil {
+		t.Error("expected an error for trailing data")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	out, canonical, err := Canonicalize([]byte(pythonIsolated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !canonical || string(out) != pythonIsolated {
+		t.Errorf("expected %s to be canonical, got %s", pythonIsolated, out)
+	}
+
+	indented := strings.Replace(pythonIsolated, ",", ",\n  ", -1)
+	out, canonical, err = Canonicalize([]byte(indented))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonical || string(out) != pythonIsolated {
+		t.Errorf("expected %s to be canonicalized, got %s", indented, out)
+	}
+
+	if _, _, err := Canonicalize([]byte(`{"foo":1}`)); err == nil {
+		t.Error("expected an error for an invalid .isolated file")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// IsNamespaceWithCompression returns true if the content in namespace is
+// stored compressed with zlib, e.g. "default-gzip".
+func IsNamespaceWithCompression(namespace string) bool {
+	return strings.HasSuffix(namespace, "-gzip") || strings.HasSuffix(namespace, "-deflate")
+}
+
+// GetZipCompressionLevel returns the zlib compression level to use for
+// filename: 0 for the ALREADY_COMPRESSED_TYPES extensions, 7 otherwise.
+func GetZipCompressionLevel(filename string) int {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for _, t := range ALREADY_COMPRESSED_TYPES {
+		if ext == t {
+			return 0
+		}
+	}
+	return 7
+}
+
+// compressedItem is an UploadItem whose content is compressed with zlib at
+// the item's compression level. The digest and size are the ones of the
+// uncompressed content.
+type compressedItem struct {
+	UploadItem
+}
+
+func (c *compressedItem) GetContent(done <-chan struct{}) (<-chan []byte, <-chan error) {
+	chIn, chInError := c.UploadItem.GetContent(done)
+	return zipCompress(done, chIn, chInError, c.GetCompressionLevel())
+}
+
+// chunkWriter sends a copy of each write to a channel.
+type chunkWriter struct {
+	done  <-chan struct{}
+	chOut chan<- []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case c.chOut <- chunk:
+		return len(p), nil
+	case <-c.done:
+		return 0, errors.New("canceled")
+	}
+}
+
+// zipCompress compresses the chunks received on chIn with zlib. Only one
+// chunk at a time is kept in memory.
+func zipCompress(done <-chan struct{}, chIn <-chan []byte, chInError <-chan error, level int) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		// Let the producer of chIn exit.
+		defer func() {
+			for range chIn {
+			}
+		}()
+		w, err := zlib.NewWriterLevel(&chunkWriter{done, chOut}, level)
+		if err != nil {
+			chError <- err
+			return
+		}
+		for chunk := range chIn {
+			if _, err := w.Write(chunk); err != nil {
+				chError <- err
+				return
+			}
+		}
+		if err := <-chInError; err != nil {
+			chError <- err
+			return
+		}
+		if err := w.Close(); err != nil {
+			chError <- err
+		}
+	}()
+	return chOut, chError
+}
+
+// zipDecompress decompresses the zlib stream received on chIn, in chunks of
+// at most NET_IO_FILE_CHUNK.
+func zipDecompress(done <-chan struct{}, chIn <-chan []byte, chInError <-chan error) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	r, w := io.Pipe()
+	go func() {
+		for chunk := range chIn {
+			if _, err := w.Write(chunk); err != nil {
+				break
+			}
+		}
+		for range chIn {
+		}
+		w.CloseWithError(<-chInError)
+	}()
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		// Unblock the writer on error.
+		defer r.Close()
+		z, err := zlib.NewReader(r)
+		if err == nil {
+			err = sendChunks(done, z, chOut)
+		}
+		if err != nil {
+			chError <- err
+		}
+	}()
+	return chOut, chError
+}
+
+// digestWriter hashes the content of an item as stored in a namespace, i.e.
+// decompressing it first for namespaces with compression.
+type digestWriter struct {
+	h hash.Hash
+	// w feeds the decompression goroutine, it is nil without compression.
+	w       *io.PipeWriter
+	chError chan error
+}
+
+func newDigestWriter(namespace string) (*digestWriter, error) {
+	h, err := NewHash(GetHashAlgo(namespace))
+	if err != nil {
+		return nil, err
+	}
+	d := &digestWriter{h: h}
+	if IsNamespaceWithCompression(namespace) {
+		r, w := io.Pipe()
+		d.w = w
+		d.chError = make(chan error, 1)
+		go func() {
+			z, err := zlib.NewReader(r)
+			if err == nil {
+				_, err = io.Copy(h, z)
+			}
+			// Unblock the writer on error.
+			r.CloseWithError(err)
+			d.chError <- err
+		}()
+	}
+	return d, nil
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	if d.w != nil {
+		return d.w.Write(p)
+	}
+	return d.h.Write(p)
+}
+
+// Digest returns the digest of the content written. It must be called exactly
+// once, after the last Write.
+func (d *digestWriter) Digest() (string, error) {
+	if d.w != nil {
+		d.w.Close()
+		if err := <-d.chError; err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(d.h.Sum(nil)), nil
+}
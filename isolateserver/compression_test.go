@@ -0,0 +1,135 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestGetZipCompressionLevel(t *testing.T) {
+	data := map[string]int{
+		"foo.txt":    7,
+		"foo":        7,
+		"a/b.zip":    0,
+		"a/b.PNG":    0,
+		"a/b.tar.7z": 0,
+		"zip":        7,
+	}
+	for filename, expected := range data {
+		if level := GetZipCompressionLevel(filename); level != expected {
+			t.Errorf("%s: expected %d, got %d", filename, expected, level)
+		}
+	}
+	for namespace, expected := range map[string]bool{"default-gzip": true, "sha256-deflate": true, "default": false, "gzip-sha1": false} {
+		if IsNamespaceWithCompression(namespace) != expected {
+			t.Errorf("%s: expected %v", namespace, expected)
+		}
+	}
+}
+
+func TestZipCompress(t *testing.T) {
+	// Random data doesn't compress, mixed with zeros that do.
+	content := make([]byte, 3*NET_IO_FILE_CHUNK+17)
+	rand.New(rand.NewSource(0)).Read(content[:NET_IO_FILE_CHUNK])
+	done := make(chan struct{})
+	defer close(done)
+	for _, level := range []int{0, 7} {
+		item := newTestItem(string(content))
+		item.CompressionLevel = level
+		compressed := []byte{}
+		chOut, chError := (&compressedItem{item}).GetContent(done)
+		for chunk := range chOut {
+			compressed = append(compressed, chunk...)
+		}
+		if err := <-chError; err != nil {
+			t.Fatal(err)
+		}
+		r, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(content, out) {
+			t.Errorf("level %d: unexpected decompressed content, %v", level, err)
+		}
+		if level == 0 && len(compressed) <= len(content) {
+			t.Errorf("expected no compression at level 0")
+		}
+		if level == 7 && len(compressed) >= len(content) {
+			t.Errorf("expected compression at level 7")
+		}
+
+		chIn := make(chan []byte, 2)
+		chIn <- compressed[:10]
+		chIn <- compressed[10:]
+		close(chIn)
+		chInError := make(chan error)
+		close(chInError)
+		out := []byte{}
+		chOut, chError = zipDecompress(done, chIn, chInError)
+		for chunk := range chOut {
+			if len(chunk) > NET_IO_FILE_CHUNK {
+				t.Errorf("chunk too large: %d", len(chunk))
+			}
+			out = append(out, chunk...)
+		}
+		if err := <-chError; err != nil || !bytes.Equal(content, out) {
+			t.Errorf("level %d: unexpected decompressed content, %v", level, err)
+		}
+	}
+
+	// A truncated stream is an error.
+	chIn := make(chan []byte, 1)
+	chIn <- []byte{0x78, 0x9c, 0x01}
+	close(chIn)
+	chInError := make(chan error)
+	close(chInError)
+	chOut, chError := zipDecompress(done, chIn, chInError)
+	for range chOut {
+	}
+	if err := <-chError; err == nil {
+		t.Error("expected an error for a truncated stream")
+	}
+}
+
+func TestStorageCompression(t *testing.T) {
+	f, ts := newFakeIsolateServer(t)
+	defer ts.Close()
+	s := NewStorage(ts.URL, "default-gzip")
+	if !s.useCompression {
+		t.Fatal("expected compression")
+	}
+	item := newTestItem(string(bytes.Repeat([]byte("compress me "), 1000)))
+	item.CompressionLevel = 7
+	done := make(chan struct{})
+	defer close(done)
+	ch := make(chan UploadItem, 1)
+	ch <- item
+	close(ch)
+	if _, err := s.Upload(done, ch); err != nil {
+		t.Fatal(err)
+	}
+	// The server has the compressed content, under the uncompressed digest.
+	stored, _ := f.get(item.Digest)
+	if len(stored) >= len(item.content) {
+		t.Errorf("expected compressed content, got %d bytes", len(stored))
+	}
+	chOut, chError := s.Fetch(done, item.Digest)
+	out := []byte{}
+	for chunk := range chOut {
+		out = append(out, chunk...)
+	}
+	if err := <-chError; err != nil || !bytes.Equal(item.content, out) {
+		t.Errorf("unexpected fetched content, %v", err)
+	}
+
+	// No compression for other namespaces.
+	if s := NewStorage(ts.URL, "default"); s.useCompression {
+		t.Error("expected no compression")
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SERVER_APP_VERSION is returned to the clients in the /handshake response.
+const SERVER_APP_VERSION = "0.1"
+
+// MIN_SIZE_FOR_DIRECT_UPLOAD is the size from which the items are uploaded
+// and then finalized instead of being stored with a single request.
+const MIN_SIZE_FOR_DIRECT_UPLOAD = 50 * 1024
+
+// DiskServer implements the server side of the /content-gs protocol of the
+// Isolate server. The items are stored in a local directory with the same
+// layout as LocalStorageApi, so the directory can also be used with a file://
+// server URL.
+//
+// Small items are stored with a single PUT to /content-gs/store. Large ones are
+// PUT to /content-gs/upload and then verified and made visible by a POST to
+// /content-gs/finalize.
+type DiskServer struct {
+	namespaces map[string]*LocalStorageApi
+	// token is the access token returned by the handshake. It is required by
+	// all the requests modifying the store.
+	token string
+}
+
+// NewDiskServer returns a DiskServer storing the items of namespaces in root.
+func NewDiskServer(root string, namespaces []string) (*DiskServer, error) {
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("at least one namespace is required")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	d := &DiskServer{namespaces: map[string]*LocalStorageApi{}, token: hex.EncodeToString(b)}
+	for _, namespace := range namespaces {
+		if namespace == "" || strings.ContainsAny(namespace, `/\.`) {
+			return nil, fmt.Errorf("invalid namespace '%s'", namespace)
+		}
+		d.namespaces[namespace] = NewLocalStorageApi(root, namespace)
+	}
+	return d, nil
+}
+
+func (d *DiskServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /content-gs/<handler>[/<namespace>[/<digest>]]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "content-gs" {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[1] == "handshake" {
+		if len(parts) != 2 || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		d.handshake(w, r)
+		return
+	}
+	if len(parts) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+	api, ok := d.namespaces[parts[2]]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown namespace '%s'", parts[2]), http.StatusNotFound)
+		return
+	}
+	if parts[1] == "pre-upload" {
+		if len(parts) != 3 || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		if d.checkToken(w, r) {
+			d.preUpload(w, r, api)
+		}
+		return
+	}
+	if len(parts) != 4 {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := api.itemPath(parts[3])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case parts[1] == "retrieve" && r.Method == "GET":
+		f, err := os.Open(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// http.ServeContent handles the Range header.
+		http.ServeContent(w, r, "", time.Time{}, f)
+
+	case parts[1] == "store" && r.Method == "PUT":
+		if d.checkToken(w, r) {
+			d.store(w, r, api, p, parts[3])
+		}
+
+	case parts[1] == "upload" && r.Method == "PUT":
+		if d.checkToken(w, r) {
+			d.upload(w, r, p)
+		}
+
+	case parts[1] == "finalize" && r.Method == "POST":
+		if d.checkToken(w, r) {
+			d.finalize(w, api, p, parts[3])
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *DiskServer) checkToken(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("token") != d.token {
+		http.Error(w, "invalid access token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (d *DiskServer) handshake(w http.ResponseWriter, r *http.Request) {
+	in := handshakeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("invalid handshake: %s", err), http.StatusBadRequest)
+		return
+	}
+	out := handshakeResponse{ProtocolVersion: ISOLATE_PROTOCOL_VERSION, ServerAppVersion: SERVER_APP_VERSION}
+	expected, _ := parseVersion(ISOLATE_PROTOCOL_VERSION)
+	if version, err := parseVersion(in.ProtocolVersion); err != nil || version[0] != expected[0] {
+		out.Error = fmt.Sprintf("unsupported protocol version %s, expected %s", in.ProtocolVersion, ISOLATE_PROTOCOL_VERSION)
+	} else {
+		out.AccessToken = d.token
+	}
+	writeJSON(w, out)
+}
+
+func (d *DiskServer) preUpload(w http.ResponseWriter, r *http.Request, api *LocalStorageApi) {
+	in := []preUploadItem{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("invalid pre-upload request: %s", err), http.StatusBadRequest)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	out := make([]interface{}, len(in))
+	for i, item := range in {
+		p, err := api.itemPath(item.Digest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		itemUrl := func(handler string) string {
+			return fmt.Sprintf("%s://%s/content-gs/%s/%s/%s?token=%s", scheme, r.Host, handler, api.namespace, item.Digest, d.token)
+		}
+		if item.Size < MIN_SIZE_FOR_DIRECT_UPLOAD {
+			out[i] = []interface{}{itemUrl("store"), nil}
+		} else {
+			out[i] = []string{itemUrl("upload"), itemUrl("finalize")}
+		}
+	}
+	writeJSON(w, out)
+}
+
+// store saves a small item once its content is verified.
+func (d *DiskServer) store(w http.ResponseWriter, r *http.Request, api *LocalStorageApi, p, digest string) {
+	if err := writeItem(p, digest, api.namespace, r.Body); err != nil {
+		log.Printf("failed to store %s: %s", digest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// upload saves a large item as pending until it is finalized.
+func (d *DiskServer) upload(w http.ResponseWriter, r *http.Request, p string) {
+	tmp, err := writeTempFile(filepath.Dir(p), r.Body)
+	if err == nil {
+		if err = os.Rename(tmp, p+".pending"); err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to upload %s: %s", p, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// finalize verifies a pending item and makes it visible.
+func (d *DiskServer) finalize(w http.ResponseWriter, api *LocalStorageApi, p, digest string) {
+	pending := p + ".pending"
+	if _, err := os.Stat(pending); err != nil {
+		http.Error(w, fmt.Sprintf("%s was not uploaded", digest), http.StatusBadRequest)
+		return
+	}
+	err := verifyFile(pending, digest, api.namespace)
+	if err == nil {
+		err = os.Rename(pending, p)
+	}
+	if err != nil {
+		os.Remove(pending)
+		log.Printf("failed to finalize %s: %s", digest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// verifyFile checks the file p, as stored in namespace, contains the item
+// digest.
+func verifyFile(p, digest, namespace string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := newDigestWriter(namespace)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, f)
+	actual, digestErr := d.Digest()
+	if err != nil {
+		return err
+	}
+	if digestErr != nil {
+		return digestErr
+	}
+	if actual != digest {
+		return fmt.Errorf("digest mismatch for %s: got %s", digest, actual)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write the response: %s", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestDiskServer(t *testing.T, namespaces ...string) (string, *httptest.Server) {
+	root, err := ioutil.TempDir("", "isolateserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDiskServer(root, namespaces)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return root, httptest.NewServer(d)
+}
+
+func TestDiskServer(t *testing.T) {
+	root, ts := newTestDiskServer(t, "default", "default-gzip")
+	defer os.RemoveAll(root)
+	defer ts.Close()
+
+	for _, namespace := range []string{"default", "default-gzip"} {
+		s := NewStorage(ts.URL, namespace)
+		small := newTestItem("small")
+		large := newTestItem(strings.Repeat("large", MIN_SIZE_FOR_DIRECT_UPLOAD))
+		for _, expected := range []int{2, 0} {
+			chItems := make(chan UploadItem, 2)
+			chItems <- small
+			chItems <- large
+			close(chItems)
+			stats, err := s.Upload(nil, chItems)
+			if err != nil || stats.ItemsCold != expected {
+				t.Fatalf("%s: expected %d items uploaded, got %s, %v", namespace, expected, stats, err)
+			}
+		}
+		for _, item := range []*testItem{small, large} {
+			chOut, chError := s.Fetch(nil, item.Digest)
+			out := ""
+			for chunk := range chOut {
+				out += string(chunk)
+			}
+			if err := <-chError; err != nil || out != string(item.content) {
+				t.Errorf("%s: unexpected fetched content %d bytes, %v", namespace, len(out), err)
+			}
+		}
+		// The store is usable directly too.
+		if out, err := fetchAll(NewLocalStorageApi(root, namespace), small.Digest, 0); err != nil || out == "" {
+			t.Errorf("%s: expected the item in the local store, got %v", namespace, err)
+		}
+	}
+
+	api := NewIsolateServer(ts.URL, "default")
+	if out, err := fetchAll(api, newTestItem(strings.Repeat("large", MIN_SIZE_FOR_DIRECT_UPLOAD)).Digest, 5); err != nil || len(out) != 5*MIN_SIZE_FOR_DIRECT_UPLOAD-5 {
+		t.Errorf("unexpected fetched content %d bytes, %v", len(out), err)
+	}
+	if _, err := fetchAll(api, "0000000000000000000000000000000000000000", 0); err == nil || isTransient(err) {
+		t.Errorf("expected a permanent error for a missing item, got %v", err)
+	}
+	if _, err := NewIsolateServer(ts.URL, "unknown").Contains(nil, []UploadItem{newTestItem("a")}); err == nil {
+		t.Error("expected an error for an unknown namespace")
+	}
+}
+
+func TestDiskServerRejects(t *testing.T) {
+	root, ts := newTestDiskServer(t, "default")
+	defer os.RemoveAll(root)
+	defer ts.Close()
+
+	api := NewIsolateServer(ts.URL, "default")
+	item := newTestItem("content")
+	missing, err := api.Contains(nil, []UploadItem{item})
+	if err != nil || len(missing) != 1 {
+		t.Fatalf("expected the item to be missing, got %v, %v", missing, err)
+	}
+	// The content doesn't match the digest.
+	done := make(chan struct{})
+	defer close(done)
+	if err := <-api.Push(done, newTestItem("other"), missing[item]); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected the push to be rejected, got %v", err)
+	}
+	if missing, err = api.Contains(nil, []UploadItem{item}); err != nil || len(missing) != 1 {
+		t.Errorf("expected the item to still be missing, got %v, %v", missing, err)
+	}
+
+	uploadUrl := strings.Replace(missing[item].UploadUrl, "token=", "token=bad", 1)
+	req, _ := http.NewRequest("PUT", uploadUrl, bytes.NewReader(item.content))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the request to be forbidden, got %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	if _, err := NewDiskServer(root, []string{"../escape"}); err == nil {
+		t.Error("expected an error for an invalid namespace")
+	}
+}
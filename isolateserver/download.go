@@ -0,0 +1,245 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+)
+
+// MAX_CONCURRENT_FETCHES is the number of files downloaded concurrently by
+// FetchIsolated.
+const MAX_CONCURRENT_FETCHES = 16
+
+// FetchIsolated downloads the tree described by the .isolated file
+// isolatedHash, and the .isolated files it includes, from s into outdir.
+//
+// The files are downloaded concurrently and each content is fetched only once.
+// The symlinks and file modes are recreated and 'read_only' is honored: 0
+// leaves the files writable, 1 makes the files read-only and 2 makes the
+// directories read-only too.
+//
+// It returns the merged .isolated file, e.g. to get the command to run.
+func FetchIsolated(done <-chan struct{}, s Storage, isolatedHash IsolateHash, outdir string) (*Isolated, error) {
+	fetch := func(h IsolateHash) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := fetchTo(done, s, string(h), &buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	content, err := fetch(isolatedHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %s", isolatedHash, err)
+	}
+	isolated, err := LoadIsolatedTree(content, s.HashAlgo(), fetch)
+	if err != nil {
+		return nil, err
+	}
+	readOnly := 0
+	if isolated.ReadOnly != nil {
+		readOnly = *isolated.ReadOnly
+	}
+
+	// Validate all the paths before writing anything.
+	names := make([]string, 0, len(isolated.Files))
+	for name := range isolated.Files {
+		clean := filepath.Clean(name)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("invalid path %q outside of the tree", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		return nil, err
+	}
+	// Group the files by digest so each content is fetched once.
+	byDigest := map[string][]string{}
+	digests := []string{}
+	links := []string{}
+	for _, name := range names {
+		f := isolated.Files[name]
+		if f.Type != "" && f.Type != "basic" {
+			return nil, fmt.Errorf("%s: file type '%s' is not supported", name, f.Type)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(outdir, name)), 0755); err != nil {
+			return nil, err
+		}
+		if f.Link != nil {
+			links = append(links, name)
+			continue
+		}
+		if _, ok := byDigest[f.Digest]; !ok {
+			digests = append(digests, f.Digest)
+		}
+		byDigest[f.Digest] = append(byDigest[f.Digest], name)
+	}
+
+	stop := make(chan struct{})
+	var once sync.Once
+	var fetchErr error
+	fail := func(err error) {
+		once.Do(func() {
+			fetchErr = err
+			close(stop)
+		})
+	}
+	go func() {
+		select {
+		case <-done:
+			fail(errors.New("fetch canceled"))
+		case <-stop:
+		}
+	}()
+	chDigests := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < MAX_CONCURRENT_FETCHES; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for digest := range chDigests {
+				if err := fetchFiles(stop, s, outdir, isolated, byDigest[digest], readOnly); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	for _, digest := range digests {
+		select {
+		case chDigests <- digest:
+		case <-stop:
+		}
+	}
+	close(chDigests)
+	wg.Wait()
+	// Release the goroutine watching done.
+	fail(nil)
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	// The symlinks are created last so no file is written through them.
+	for _, name := range links {
+		if err := os.Symlink(*isolated.Files[name].Link, filepath.Join(outdir, name)); err != nil {
+			return nil, err
+		}
+	}
+	if readOnly == 2 {
+		if err := makeTreeReadOnly(outdir); err != nil {
+			return nil, err
+		}
+	}
+	return isolated, nil
+}
+
+// fetchFiles fetches the content shared by the files names into the first one
+// and copies it to the others.
+func fetchFiles(done <-chan struct{}, s Storage, outdir string, isolated *Isolated, names []string, readOnly int) error {
+	first := filepath.Join(outdir, names[0])
+	if err := writeFile(first, func(w io.Writer) error {
+		return fetchTo(done, s, isolated.Files[names[0]].Digest, w)
+	}); err != nil {
+		return fmt.Errorf("failed to fetch %s: %s", names[0], err)
+	}
+	for _, name := range names[1:] {
+		if err := writeFile(filepath.Join(outdir, name), func(w io.Writer) error {
+			f, err := os.Open(first)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	// Set the modes once all the copies are done, since the first file may
+	// become read-only.
+	for _, name := range names {
+		if err := os.Chmod(filepath.Join(outdir, name), fileMode(isolated.Files[name], readOnly)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchTo writes the content of digest to w.
+func fetchTo(done <-chan struct{}, s Storage, digest string, w io.Writer) error {
+	chOut, chError := s.Fetch(done, digest)
+	var err error
+	for chunk := range chOut {
+		if err == nil {
+			_, err = w.Write(chunk)
+		}
+	}
+	if fetchErr := <-chError; err == nil {
+		err = fetchErr
+	}
+	return err
+}
+
+// writeFile creates the file p with the content written by write.
+func writeFile(p string, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fileMode returns the mode of the file f once downloaded.
+func fileMode(f IsolatedFile, readOnly int) os.FileMode {
+	mode := os.FileMode(0644)
+	if f.Mode != nil {
+		mode = os.FileMode(*f.Mode) & os.ModePerm
+	}
+	if readOnly == 0 {
+		return mode | 0200
+	}
+	return mode &^ 0222
+}
+
+// makeTreeReadOnly removes the write permission of all the directories in
+// root, including root.
+func makeTreeReadOnly(root string) error {
+	dirs := []string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(dirs[i], info.Mode().Perm()&^0222); err != nil {
+			return err
+		}
+	}
+	return nil
+}
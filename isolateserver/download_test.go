@@ -0,0 +1,160 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+)
+
+// uploadIsolated uploads contents and the .isolated files of isolateds, the
+// last one including the others, and returns the hash of the last one.
+func uploadIsolated(t *testing.T, s Storage, contents []string, isolateds ...*Isolated) IsolateHash {
+	items := []UploadItem{}
+	for _, content := range contents {
+		item, _ := NewBufferItem([]byte(content), s.HashAlgo(), false)
+		items = append(items, item)
+	}
+	var hash IsolateHash
+	for i, isolated := range isolateds {
+		if i == len(isolateds)-1 {
+			isolated.Includes = nil
+			for _, include := range items[len(contents):] {
+				isolated.Includes = append(isolated.Includes, IsolateHash(include.GetDigest()))
+			}
+		}
+		data, err := isolated.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, _ := NewBufferItem(data, s.HashAlgo(), true)
+		items = append(items, item)
+		hash = IsolateHash(item.Digest)
+	}
+	chItems := make(chan UploadItem, len(items))
+	for _, item := range items {
+		chItems <- item
+	}
+	close(chItems)
+	if _, err := s.Upload(nil, chItems); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestFetchIsolated(t *testing.T) {
+	root, err := ioutil.TempDir("", "isolateserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// Make the tree writable again to be able to delete it.
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(p, 0755)
+			}
+			return nil
+		})
+		os.RemoveAll(root)
+	}()
+	s := NewStorage(LocalStoreURL(filepath.Join(root, "store")), "default-gzip")
+	digest := func(content string) string {
+		d, _ := HashBytes([]byte(content), "sha-1")
+		return d
+	}
+	file := func(content string, mode int) IsolatedFile {
+		size := int64(len(content))
+		return IsolatedFile{Digest: digest(content), Mode: &mode, Size: &size}
+	}
+	link := "../a"
+	large := strings.Repeat("large", 100000)
+
+	for _, readOnly := range []int{0, 1, 2} {
+		child := NewIsolated("sha-1")
+		child.Files["a"] = file("a", 0755)
+		child.Files[filepath.Join("sub", "b")] = file(large, 0640)
+		child.Files[filepath.Join("sub", "a")] = file("shadowed", 0644)
+		parent := NewIsolated("sha-1")
+		parent.Command = []string{"run"}
+		parent.ReadOnly = &readOnly
+		parent.Files[filepath.Join("sub", "a")] = file("a", 0600)
+		parent.Files[filepath.Join("sub", "l")] = IsolatedFile{Link: &link}
+		hash := uploadIsolated(t, s, []string{"a", large, "shadowed"}, child, parent)
+
+		outdir := filepath.Join(root, "out", strconv.Itoa(readOnly))
+		isolated, err := FetchIsolated(nil, s, hash, outdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(isolated.Command) != 1 || len(isolated.Files) != 4 {
+			t.Errorf("unexpected isolated %v", isolated)
+		}
+		expected := []struct {
+			name    string
+			content string
+			mode    os.FileMode
+		}{
+			{"a", "a", 0755},
+			{filepath.Join("sub", "a"), "a", 0600},
+			{filepath.Join("sub", "b"), large, 0640},
+		}
+		for _, e := range expected {
+			p := filepath.Join(outdir, e.name)
+			content, err := ioutil.ReadFile(p)
+			if err != nil || string(content) != e.content {
+				t.Errorf("%d: %s: unexpected content, %v", readOnly, e.name, err)
+			}
+			if readOnly != 0 {
+				e.mode &^= 0222
+			}
+			if fi, err := os.Stat(p); err != nil || fi.Mode() != e.mode {
+				t.Errorf("%d: %s: expected mode %s, got %v, %v", readOnly, e.name, e.mode, fi.Mode(), err)
+			}
+		}
+		if l, err := os.Readlink(filepath.Join(outdir, "sub", "l")); err != nil || l != link {
+			t.Errorf("%d: unexpected link %s, %v", readOnly, l, err)
+		}
+		fi, err := os.Stat(filepath.Join(outdir, "sub"))
+		if err != nil || (fi.Mode()&0200 == 0) != (readOnly == 2) {
+			t.Errorf("%d: unexpected directory mode %v, %v", readOnly, fi.Mode(), err)
+		}
+	}
+}
+
+func TestFetchIsolatedErrors(t *testing.T) {
+	root, err := ioutil.TempDir("", "isolateserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := NewStorage(LocalStoreURL(filepath.Join(root, "store")), "default")
+
+	size := int64(1)
+	for _, name := range []string{"../escape", "/abs", "."} {
+		isolated := NewIsolated("sha-1")
+		isolated.Files[name] = IsolatedFile{Digest: "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8", Size: &size}
+		hash := uploadIsolated(t, s, nil, isolated)
+		if _, err := FetchIsolated(nil, s, hash, filepath.Join(root, "out")); err == nil || !strings.Contains(err.Error(), "outside of the tree") {
+			t.Errorf("%s: expected an invalid path error, got %v", name, err)
+		}
+	}
+
+	// The content of the file is not in the store.
+	isolated := NewIsolated("sha-1")
+	isolated.Files["a"] = IsolatedFile{Digest: "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8", Size: &size}
+	hash := uploadIsolated(t, s, nil, isolated)
+	if _, err := FetchIsolated(nil, s, hash, filepath.Join(root, "out")); err == nil || !strings.Contains(err.Error(), "failed to fetch a") {
+		t.Errorf("expected a fetch error, got %v", err)
+	}
+	if _, err := FetchIsolated(nil, s, "0000000000000000000000000000000000000000", filepath.Join(root, "out2")); err == nil {
+		t.Error("expected an error for a missing .isolated file")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"chromium.googlesource.com/infra/swarming/client-go/internal/common"
+)
+
+// ServerFlags are the command line flags selecting the isolate server and the
+// namespace, shared by the commands talking to an isolate server.
+type ServerFlags struct {
+	ServerURL  string
+	Namespace  string
+	LocalStore string
+}
+
+// Init registers the flags in f, with defaultNamespace as the default
+// -namespace.
+func (s *ServerFlags) Init(f *flag.FlagSet, defaultNamespace string) {
+	f.StringVar(&s.ServerURL, "isolate-server",
+		"https://isolateserver-dev.appspot.com/", "")
+	f.StringVar(&s.ServerURL, "I",
+		"https://isolateserver-dev.appspot.com/", "")
+	f.StringVar(&s.Namespace, "namespace", defaultNamespace, "")
+	f.StringVar(&s.LocalStore, "local-store", "",
+		"Directory to use as the isolate server instead of -isolate-server")
+}
+
+// Parse validates the flags once parsed. ServerURL is normalized, and set to
+// the file:// URL of the -local-store directory if specified. Plain http:// is
+// only accepted for a server on the loopback interface.
+func (s *ServerFlags) Parse() error {
+	if s.LocalStore != "" {
+		dir, err := filepath.Abs(s.LocalStore)
+		if err != nil {
+			return err
+		}
+		s.ServerURL = LocalStoreURL(dir)
+	}
+	if s.ServerURL == "" {
+		return errors.New("-isolate-server must be specified")
+	}
+	if strings.HasPrefix(s.ServerURL, "file://") {
+		// Local store, see LocalStorageApi.
+	} else if isLoopbackHTTP(s.ServerURL) {
+		// Local server, e.g. 'isolateserver serve'.
+	} else if u, err := common.URLToHTTPS(s.ServerURL); err != nil {
+		return err
+	} else {
+		s.ServerURL = u
+	}
+	if s.Namespace == "" {
+		return errors.New("-namespace must be specified")
+	}
+	return nil
+}
+
+// isLoopbackHTTP returns true if serverUrl is a http:// URL of a server on the
+// loopback interface.
+func isLoopbackHTTP(serverUrl string) bool {
+	u, err := url.Parse(serverUrl)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.Trim(host, "[]")
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerFlags(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		args      []string
+		serverURL string
+		namespace string
+	}{
+		{[]string{}, "https://isolateserver-dev.appspot.com/", "default"},
+		{[]string{"-I", "example.com", "-namespace", "default-gzip"}, "https://example.com", "default-gzip"},
+		{[]string{"-isolate-server", "https://example.com"}, "https://example.com", "default"},
+		{[]string{"-local-store", "store"}, LocalStoreURL(filepath.Join(cwd, "store")), "default"},
+		{[]string{"-I", LocalStoreURL("/store")}, LocalStoreURL("/store"), "default"},
+		{[]string{"-I", "http://localhost:8080"}, "http://localhost:8080", "default"},
+		{[]string{"-I", "http://127.0.0.1:8080/"}, "http://127.0.0.1:8080/", "default"},
+		{[]string{"-I", "http://[::1]"}, "http://[::1]", "default"},
+	}
+	for _, line := range data {
+		s := ServerFlags{}
+		f := flag.NewFlagSet("test", flag.ContinueOnError)
+		s.Init(f, "default")
+		if err := f.Parse(line.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Parse(); err != nil || s.ServerURL != line.serverURL || s.Namespace != line.namespace {
+			t.Errorf("%v: unexpected %s (%s), %v", line.args, s.ServerURL, s.Namespace, err)
+		}
+	}
+
+	for _, args := range [][]string{{"-I", ""}, {"-namespace", ""}, {"-I", "ftp://example.com"}, {"-I", "http://example.com"}, {"-I", "http://10.0.0.1:8080"}} {
+		s := ServerFlags{}
+		f := flag.NewFlagSet("test", flag.ContinueOnError)
+		s.Init(f, "default")
+		if err := f.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Parse(); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// SUPPORTED_ALGOS maps the names of the hashing algorithms, as used in the
+// 'algo' field of .isolated files, to their implementation.
+var SUPPORTED_ALGOS = map[string]func() hash.Hash{
+	"sha-1":   sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// GetHashAlgo returns the hashing algorithm to use for namespace.
+//
+// Namespaces starting with "sha256-" or "sha512-" use SHA-256 or SHA-512,
+// e.g. "sha256-deflate", all the others use SHA-1, e.g. "default-gzip".
+func GetHashAlgo(namespace string) string {
+	switch {
+	case strings.HasPrefix(namespace, "sha256-"):
+		return "sha-256"
+	case strings.HasPrefix(namespace, "sha512-"):
+		return "sha-512"
+	default:
+		return "sha-1"
+	}
+}
+
+// NewHash returns a new hash.Hash for algo.
+func NewHash(algo string) (hash.Hash, error) {
+	h, ok := SUPPORTED_ALGOS[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hashing algorithm '%s', expected one of '%s'",
+			algo, strings.Join(supportedAlgos(), ", "))
+	}
+	return h(), nil
+}
+
+// HashBytes returns the hex encoded digest of data.
+func HashBytes(data []byte, algo string) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// IsValidHash returns true if h is a valid hex encoded digest for algo.
+func IsValidHash(h, algo string) bool {
+	newHash, ok := SUPPORTED_ALGOS[algo]
+	if !ok || len(h) != newHash().Size()*2 {
+		return false
+	}
+	for _, c := range h {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func supportedAlgos() []string {
+	out := make([]string, 0, len(SUPPORTED_ALGOS))
+	for algo := range SUPPORTED_ALGOS {
+		out = append(out, algo)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetHashAlgo(t *testing.T) {
+	data := map[string]string{
+		"default":        "sha-1",
+		"default-gzip":   "sha-1",
+		"testing":        "sha-1",
+		"sha256-deflate": "sha-256",
+		"sha256-":        "sha-256",
+		"sha512-gzip":    "sha-512",
+		"sha256":         "sha-1",
+	}
+	for namespace, expected := range data {
+		if algo := GetHashAlgo(namespace); algo != expected {
+			t.Errorf("%s: expected %s, got %s", namespace, expected, algo)
+		}
+	}
+}
+
+func TestHashBytes(t *testing.T) {
+	data := []struct {
+		algo     string
+		expected string
+	}{
+		{"sha-1", "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"},
+		{"sha-256", "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+	}
+	for _, line := range data {
+		h, err := HashBytes([]byte("foo"), line.algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != line.expected {
+			t.Errorf("%s: expected %s, got %s", line.algo, line.expected, h)
+		}
+		if !IsValidHash(h, line.algo) {
+			t.Errorf("%s: expected %s to be valid", line.algo, h)
+		}
+	}
+	if _, err := HashBytes(nil, "md4"); err == nil || !strings.Contains(err.Error(), "unknown hashing algorithm 'md4'") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestIsValidHash(t *testing.T) {
+	sha1 := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+	sha256 := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	data := []struct {
+		h, algo  string
+		expected bool
+	}{
+		{sha1, "sha-1", true},
+		{sha256, "sha-256", true},
+		{sha1, "sha-256", false},
+		{sha256, "sha-1", false},
+		{strings.ToUpper(sha1), "sha-1", false},
+		{sha1, "md4", false},
+	}
+	for _, line := range data {
+		if got := IsValidHash(line.h, line.algo); got != line.expected {
+			t.Errorf("IsValidHash(%s, %s) = %v, expected %v", line.h, line.algo, got, line.expected)
+		}
+	}
+}
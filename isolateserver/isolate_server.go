@@ -0,0 +1,406 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CLIENT_APP_VERSION is sent to the server in the /handshake request.
+const CLIENT_APP_VERSION = "0.1"
+
+// NET_IO_FILE_CHUNK is the chunk size to use when reading from network
+// stream.
+const NET_IO_FILE_CHUNK = 16 * 1024
+
+// URL_OPEN_TIMEOUT is the maximum time to connect to the server and to get the
+// response headers. The transfer of the content is not bounded, since items can
+// be large, but it can be canceled with the done channel.
+const URL_OPEN_TIMEOUT = 60 * time.Second
+
+// JSON_TIMEOUT is the maximum duration of the requests exchanging JSON, e.g.
+// /handshake and /pre-upload.
+const JSON_TIMEOUT = 5 * time.Minute
+
+var contentRangeRe = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+
+// IsolateServer is a StorageApi implementation that talks to the Isolate
+// server over HTTP.
+//
+// The handshake with the server is done on the first call that needs it.
+type IsolateServer struct {
+	baseUrl, namespace string
+	// client is used to transfer the items and jsonClient for the JSON requests.
+	client, jsonClient *http.Client
+
+	lock        sync.Mutex
+	accessToken string
+}
+
+// handshakeRequest is sent to /content-gs/handshake.
+type handshakeRequest struct {
+	ClientAppVersion string `json:"client_app_version"`
+	Fetcher          bool   `json:"fetcher"`
+	ProtocolVersion  string `json:"protocol_version"`
+	Pusher           bool   `json:"pusher"`
+}
+
+// handshakeResponse is the reply to /content-gs/handshake.
+type handshakeResponse struct {
+	AccessToken      string `json:"access_token"`
+	Error            string `json:"error"`
+	ProtocolVersion  string `json:"protocol_version"`
+	ServerAppVersion string `json:"server_app_version"`
+}
+
+// preUploadItem is an entry sent to /content-gs/pre-upload.
+type preUploadItem struct {
+	Digest string `json:"h"`
+	Size   int64  `json:"s"`
+	// IsIsolated is 1 for .isolated files, 0 otherwise.
+	IsIsolated int `json:"i"`
+}
+
+// NewIsolateServer returns a StorageApi for the namespace on the Isolate
+// server at serverUrl.
+func NewIsolateServer(serverUrl, namespace string) *IsolateServer {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   URL_OPEN_TIMEOUT,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   URL_OPEN_TIMEOUT,
+		ResponseHeaderTimeout: URL_OPEN_TIMEOUT,
+	}
+	return &IsolateServer{
+		baseUrl:    strings.TrimRight(serverUrl, "/"),
+		namespace:  namespace,
+		client:     &http.Client{Transport: transport},
+		jsonClient: &http.Client{Transport: transport, Timeout: JSON_TIMEOUT},
+	}
+}
+
+func (i *IsolateServer) Location() string {
+	return i.baseUrl
+}
+
+func (i *IsolateServer) Namespace() string {
+	return i.namespace
+}
+
+func (i *IsolateServer) GetFetchUrl(digest string) (string, error) {
+	return fmt.Sprintf("%s/content-gs/retrieve/%s/%s", i.baseUrl, url.QueryEscape(i.namespace), digest), nil
+}
+
+// Fetch retrieves the content of digest, starting at offset.
+//
+// When offset is not 0, the server must honor the Range request and return the
+// whole tail of the content.
+func (i *IsolateServer) Fetch(done <-chan struct{}, digest string, offset int64) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		if err := i.fetch(done, digest, offset, chOut); err != nil {
+			chError <- err
+		}
+	}()
+	return chOut, chError
+}
+
+func (i *IsolateServer) fetch(done <-chan struct{}, digest string, offset int64, chOut chan<- []byte) error {
+	fetchUrl, err := i.GetFetchUrl(digest)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", fetchUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = done
+	if offset != 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := i.do(i.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if offset != 0 {
+		if err := checkContentRange(resp.Header.Get("Content-Range"), offset); err != nil {
+			return err
+		}
+	}
+	if err := sendChunks(done, resp.Body, chOut); err != nil {
+		return fmt.Errorf("failed to fetch %s: %s", digest, err)
+	}
+	return nil
+}
+
+// sendChunks reads r until EOF and sends the content to chOut in chunks of at
+// most NET_IO_FILE_CHUNK.
+func sendChunks(done <-chan struct{}, r io.Reader, chOut chan<- []byte) error {
+	for {
+		buf := make([]byte, NET_IO_FILE_CHUNK)
+		n, err := r.Read(buf)
+		if n != 0 {
+			select {
+			case chOut <- buf[:n]:
+			case <-done:
+				return errors.New("canceled")
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkContentRange verifies the server returned the whole content starting
+// at offset. The header is formatted as 'bytes <offset>-<last byte>/<size>',
+// where size can be '*' when unknown.
+func checkContentRange(contentRange string, offset int64) error {
+	if contentRange == "" {
+		return errors.New("missing Content-Range header")
+	}
+	match := contentRangeRe.FindStringSubmatch(contentRange)
+	if match == nil {
+		return fmt.Errorf("invalid Content-Range header: %s", contentRange)
+	}
+	contentOffset, err1 := strconv.ParseInt(match[1], 10, 64)
+	lastByte, err2 := strconv.ParseInt(match[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("invalid Content-Range header: %s", contentRange)
+	}
+	if contentOffset != offset {
+		return fmt.Errorf("expected offset %d, got %d (Content-Range: %s)", offset, contentOffset, contentRange)
+	}
+	if match[3] != "*" {
+		size, err := strconv.ParseInt(match[3], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Content-Range header: %s", contentRange)
+		}
+		if lastByte+1 != size {
+			return fmt.Errorf("incomplete response, Content-Range: %s", contentRange)
+		}
+	}
+	return nil
+}
+
+// Push uploads the content of item to the upload URL of pushState and then
+// finalizes the upload if the server requested it.
+func (i *IsolateServer) Push(done <-chan struct{}, item UploadItem, pushState PushState) <-chan error {
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chError)
+		if err := i.push(done, item, pushState); err != nil {
+			chError <- fmt.Errorf("failed to push %s: %s", item.GetDigest(), err)
+		}
+	}()
+	return chError
+}
+
+func (i *IsolateServer) push(done <-chan struct{}, item UploadItem, pushState PushState) error {
+	if pushState.UploadUrl == "" {
+		return errors.New("the item must go through Contains first")
+	}
+	// Stream the content to the server, item may be larger than the memory.
+	chContent, chContentError := item.GetContent(done)
+	r, w := io.Pipe()
+	go func() {
+		for chunk := range chContent {
+			if _, err := w.Write(chunk); err != nil {
+				break
+			}
+		}
+		// Drain the content in case the write failed.
+		for range chContent {
+		}
+		w.CloseWithError(<-chContentError)
+	}()
+	req, err := http.NewRequest("PUT", pushState.UploadUrl, r)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	req.Cancel = done
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := i.do(i.client, req)
+	// Unblock the writer if the request failed before reading all the content.
+	r.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if pushState.FinalizeUrl != "" {
+		req, err := http.NewRequest("POST", pushState.FinalizeUrl, bytes.NewReader(nil))
+		if err != nil {
+			return err
+		}
+		req.Cancel = done
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		resp, err := i.do(i.client, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Contains sends the items to /content-gs/pre-upload in a single request.
+//
+// The server replies with an upload ticket for each missing item: a small item
+// is stored inline with a single request to its upload URL, a large one is
+// uploaded to its upload URL and then finalized.
+func (i *IsolateServer) Contains(done <-chan struct{}, items []UploadItem) (map[UploadItem]PushState, error) {
+	token, err := i.handshake(done)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]preUploadItem, len(items))
+	for j, item := range items {
+		body[j] = preUploadItem{Digest: item.GetDigest(), Size: item.GetSize()}
+		if item.IsHighPriority() {
+			body[j].IsIsolated = 1
+		}
+	}
+	var tickets [][]*string
+	preUploadUrl := fmt.Sprintf("%s/content-gs/pre-upload/%s?token=%s",
+		i.baseUrl, url.QueryEscape(i.namespace), url.QueryEscape(token))
+	if err := i.postJSON(done, preUploadUrl, body, &tickets); err != nil {
+		return nil, err
+	}
+	if len(tickets) != len(items) {
+		return nil, fmt.Errorf("got %d items from pre-upload, expected %d", len(tickets), len(items))
+	}
+	missing := map[UploadItem]PushState{}
+	for j, ticket := range tickets {
+		if ticket == nil {
+			// The item is already on the server.
+			continue
+		}
+		if len(ticket) != 2 || ticket[0] == nil {
+			return nil, fmt.Errorf("invalid upload ticket for %s", items[j].GetDigest())
+		}
+		pushState := PushState{UploadUrl: *ticket[0]}
+		if ticket[1] != nil {
+			pushState.FinalizeUrl = *ticket[1]
+		}
+		missing[items[j]] = pushState
+	}
+	return missing, nil
+}
+
+// handshake does the handshake with the server, if it was not done yet, and
+// returns the access token.
+func (i *IsolateServer) handshake(done <-chan struct{}) (string, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.accessToken != "" {
+		return i.accessToken, nil
+	}
+	in := handshakeRequest{CLIENT_APP_VERSION, true, ISOLATE_PROTOCOL_VERSION, true}
+	out := handshakeResponse{}
+	if err := i.postJSON(done, i.baseUrl+"/content-gs/handshake", &in, &out); err != nil {
+		return "", fmt.Errorf("handshake failed: %s", err)
+	}
+	if out.Error != "" {
+		return "", fmt.Errorf("handshake failed: %s", out.Error)
+	}
+	if out.AccessToken == "" {
+		return "", errors.New("handshake failed: no access token")
+	}
+	expected, _ := parseVersion(ISOLATE_PROTOCOL_VERSION)
+	if version, err := parseVersion(out.ProtocolVersion); err != nil || version[0] != expected[0] {
+		return "", fmt.Errorf("server uses protocol version %s, expected %s",
+			out.ProtocolVersion, ISOLATE_PROTOCOL_VERSION)
+	}
+	i.accessToken = out.AccessToken
+	return i.accessToken, nil
+}
+
+// postJSON sends in encoded as JSON and decodes the response in out.
+func (i *IsolateServer) postJSON(done <-chan struct{}, postUrl string, in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", postUrl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Cancel = done
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := i.do(i.jsonClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bad response %s: %s", req.URL.Path, err)
+	}
+	return nil
+}
+
+// do sends req with client and returns an error for HTTP error statuses.
+func (i *IsolateServer) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		// Don't leak the access token in the query.
+		return nil, &HTTPError{
+			StatusCode: resp.StatusCode,
+			msg:        fmt.Sprintf("%s %s: http status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(msg))),
+		}
+	}
+	return resp, nil
+}
+
+// HTTPError is returned when the server replies with an HTTP error status.
+type HTTPError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *HTTPError) Error() string {
+	return e.msg
+}
+
+// isTransient returns true if the request that failed with err can be
+// retried. Client errors, e.g. 404, and local file errors are permanent.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *HTTPError:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout
+	case *os.PathError:
+		return false
+	}
+	return true
+}
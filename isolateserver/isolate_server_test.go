@@ -0,0 +1,277 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIsolateServer implements the server side of the /content-gs protocol.
+// Items larger than inlineMax are uploaded to a separate URL and finalized.
+type fakeIsolateServer struct {
+	t         *testing.T
+	url       string
+	inlineMax int64
+
+	lock     sync.Mutex
+	contents map[string][]byte
+	// pending are the large items uploaded but not finalized yet.
+	pending map[string][]byte
+}
+
+func newFakeIsolateServer(t *testing.T) (*fakeIsolateServer, *httptest.Server) {
+	f := &fakeIsolateServer{t: t, inlineMax: 8, contents: map[string][]byte{}, pending: map[string][]byte{}}
+	ts := httptest.NewServer(f)
+	f.url = ts.URL
+	return f, ts
+}
+
+func (f *fakeIsolateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "content-gs" {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[1] != "handshake" && parts[1] != "retrieve" && r.URL.Query().Get("token") != "secret" {
+		http.Error(w, "bad token", http.StatusForbidden)
+		return
+	}
+	switch {
+	case parts[1] == "handshake" && r.Method == "POST":
+		in := handshakeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.ProtocolVersion != ISOLATE_PROTOCOL_VERSION {
+			http.Error(w, "bad handshake", http.StatusBadRequest)
+			return
+		}
+		f.writeJSON(w, handshakeResponse{AccessToken: "secret", ProtocolVersion: "1.0", ServerAppVersion: "fake"})
+
+	case parts[1] == "pre-upload" && r.Method == "POST" && len(parts) == 3:
+		in := []preUploadItem{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := []interface{}{}
+		for _, item := range in {
+			if _, ok := f.contents[item.Digest]; ok {
+				out = append(out, nil)
+			} else if item.Size <= f.inlineMax {
+				out = append(out, []interface{}{fmt.Sprintf("%s/content-gs/store/%s/%s?token=secret", f.url, parts[2], item.Digest), nil})
+			} else {
+				out = append(out, []string{
+					fmt.Sprintf("%s/content-gs/gs/%s?token=secret", f.url, item.Digest),
+					fmt.Sprintf("%s/content-gs/finalize/%s?token=secret", f.url, item.Digest),
+				})
+			}
+		}
+		f.writeJSON(w, out)
+
+	case parts[1] == "store" && r.Method == "PUT" && len(parts) == 4:
+		f.contents[parts[3]] = f.readBody(r)
+
+	case parts[1] == "gs" && r.Method == "PUT" && len(parts) == 3:
+		f.pending[parts[2]] = f.readBody(r)
+
+	case parts[1] == "finalize" && r.Method == "POST" && len(parts) == 3:
+		content, ok := f.pending[parts[2]]
+		if !ok {
+			http.Error(w, "not uploaded", http.StatusBadRequest)
+			return
+		}
+		delete(f.pending, parts[2])
+		f.contents[parts[2]] = content
+
+	case parts[1] == "retrieve" && r.Method == "GET" && len(parts) == 4:
+		content, ok := f.contents[parts[3]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// http.ServeContent handles the Range header.
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(content)))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// get returns the content stored for digest and the number of uploads not
+// finalized.
+func (f *fakeIsolateServer) get(digest string) (string, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return string(f.contents[digest]), len(f.pending)
+}
+
+func (f *fakeIsolateServer) readBody(r *http.Request) []byte {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+	}
+	return content
+}
+
+func (f *fakeIsolateServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Error(err)
+	}
+}
+
+// testItem is an UploadItem with its content in memory.
+type testItem struct {
+	Item
+	content []byte
+}
+
+func newTestItem(content string) *testItem {
+	digest, _ := HashBytes([]byte(content), "sha-1")
+	return &testItem{Item{Digest: digest, Size: int64(len(content))}, []byte(content)}
+}
+
+func (i *testItem) GetContent(done <-chan struct{}) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte, 2)
+	chError := make(chan error)
+	// Send the content in two chunks.
+	chOut <- i.content[:len(i.content)/2]
+	chOut <- i.content[len(i.content)/2:]
+	close(chOut)
+	close(chError)
+	return chOut, chError
+}
+
+func fetchAll(api StorageApi, digest string, offset int64) (string, error) {
+	done := make(chan struct{})
+	defer close(done)
+	chOut, chError := api.Fetch(done, digest, offset)
+	out := ""
+	for chunk := range chOut {
+		out += string(chunk)
+	}
+	return out, <-chError
+}
+
+func TestIsolateServer(t *testing.T) {
+	f, ts := newFakeIsolateServer(t)
+	defer ts.Close()
+	api := GetStorageApi(ts.URL+"/", "default-gzip")
+	if api.Location() != ts.URL || api.Namespace() != "default-gzip" {
+		t.Errorf("unexpected location %s and namespace %s", api.Location(), api.Namespace())
+	}
+
+	small := newTestItem("small")
+	large := newTestItem(strings.Repeat("large", 10000))
+	present := newTestItem("present")
+	f.contents[present.Digest] = present.content
+	missing, err := api.Contains(nil, []UploadItem{small, large, present})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 2 || missing[small].FinalizeUrl != "" || missing[large].FinalizeUrl == "" {
+		t.Fatalf("unexpected push states %v", missing)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	for _, item := range []*testItem{small, large} {
+		if err := <-api.Push(done, item, missing[item]); err != nil {
+			t.Fatal(err)
+		}
+		if content, pending := f.get(item.Digest); content != string(item.content) || pending != 0 {
+			t.Errorf("%s: unexpected content on the server, %d uploads not finalized", item.Digest, pending)
+		}
+	}
+	if missing, err = api.Contains(nil, []UploadItem{small, large}); err != nil || len(missing) != 0 {
+		t.Errorf("expected the items to be present, got %v, %v", missing, err)
+	}
+
+	if out, err := fetchAll(api, large.Digest, 0); err != nil || out != string(large.content) {
+		t.Errorf("unexpected fetched content %d bytes, %v", len(out), err)
+	}
+	if out, err := fetchAll(api, large.Digest, 5); err != nil || out != string(large.content[5:]) {
+		t.Errorf("unexpected fetched content %d bytes, %v", len(out), err)
+	}
+	if _, err := fetchAll(api, "0000000000000000000000000000000000000000", 0); err == nil {
+		t.Error("expected an error for a missing item")
+	}
+	if err := <-api.Push(done, small, PushState{}); err == nil {
+		t.Error("expected an error without push state")
+	}
+}
+
+func TestIsolateServerHandshakeError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, `{"error":"go away"}`)
+	}))
+	defer ts.Close()
+	api := NewIsolateServer(ts.URL, "default-gzip")
+	if _, err := api.Contains(nil, []UploadItem{newTestItem("a")}); err == nil || !strings.Contains(err.Error(), "go away") {
+		t.Errorf("expected handshake error, got %v", err)
+	}
+}
+
+func TestIsolateServerCancel(t *testing.T) {
+	// The server never replies.
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	api := NewIsolateServer(ts.URL, "default-gzip")
+	if api.jsonClient.Timeout == 0 {
+		t.Error("expected a timeout on JSON requests")
+	}
+	done := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+	chError := make(chan error)
+	go func() {
+		_, err := api.Contains(done, []UploadItem{newTestItem("a")})
+		chError <- err
+	}()
+	select {
+	case err := <-chError:
+		if err == nil {
+			t.Error("expected an error once canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Contains was not canceled")
+	}
+}
+
+func TestCheckContentRange(t *testing.T) {
+	data := []struct {
+		header   string
+		expected string
+	}{
+		{"bytes 5-9/10", ""},
+		{"bytes 5-9/*", ""},
+		{"", "missing"},
+		{"bytes 4-9/10", "expected offset 5"},
+		{"bytes 5-8/10", "incomplete"},
+		{"5-9/10", "invalid"},
+	}
+	for _, line := range data {
+		err := checkContentRange(line.header, 5)
+		if line.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", line.header, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), line.expected) {
+			t.Errorf("%s: expected error %q, got %v", line.header, line.expected, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+)
+
+// ISOLATED_FILE_VERSION is the version of the .isolated file format generated.
+// Only the major version must match when loading a .isolated file.
+const ISOLATED_FILE_VERSION = "1.4"
+
+// SUPPORTED_FILE_TYPES is the list of values accepted for the 't' key of an
+// entry in 'files'.
+var SUPPORTED_FILE_TYPES = []string{"basic", "ar", "tar"}
+
+// IsolatedFile is an entry in the 'files' section of an .isolated file.
+//
+// Exactly one of Digest and Link is set. Size is set along Digest and Mode
+// can't be set along Link.
+type IsolatedFile struct {
+	// Digest is the hash of the file content.
+	Digest string `json:"h,omitempty"`
+	// Link is the destination of a symlink.
+	Link *string `json:"l,omitempty"`
+	// Mode is the file mode. It is not set on Windows.
+	Mode *int `json:"m,omitempty"`
+	// Size is the size of the file in bytes.
+	Size *int64 `json:"s,omitempty"`
+	// Type is the type of the file, one of SUPPORTED_FILE_TYPES. Defaults to
+	// "basic" when not set.
+	Type string `json:"t,omitempty"`
+}
+
+// Isolated is the content of an .isolated file.
+//
+// The fields are declared in alphabetical order of their JSON keys so the
+// encoding has sorted keys, like the Python client writes them.
+type Isolated struct {
+	Algo        string                  `json:"algo"`
+	Command     []string                `json:"command,omitempty"`
+	Files       map[string]IsolatedFile `json:"files"`
+	Includes    []IsolateHash           `json:"includes,omitempty"`
+	ReadOnly    *int                    `json:"read_only,omitempty"`
+	RelativeCwd string                  `json:"relative_cwd,omitempty"`
+	Version     string                  `json:"version"`
+}
+
+// NewIsolated returns an empty Isolated using algo.
+func NewIsolated(algo string) *Isolated {
+	return &Isolated{
+		Algo:    algo,
+		Files:   map[string]IsolatedFile{},
+		Version: ISOLATED_FILE_VERSION,
+	}
+}
+
+// Marshal encodes the .isolated file as canonical JSON, like the Python client
+// does.
+func (i *Isolated) Marshal() ([]byte, error) {
+	if i.Files == nil {
+		// 'files' is always written, even when empty.
+		c := *i
+		c.Files = map[string]IsolatedFile{}
+		i = &c
+	}
+	return CanonicalJSON(i)
+}
+
+// SaveIsolated writes the .isolated file at path.
+func SaveIsolated(path string, isolated *Isolated) error {
+	data, err := isolated.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// LoadIsolated verifies and decodes the content of an .isolated file.
+//
+// algo is the hashing algorithm expected; if empty, the one specified in the
+// file is used, defaulting to "sha-1".
+func LoadIsolated(content []byte, algo string) (*Isolated, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse: %s", err)
+	}
+	out := &Isolated{}
+	if err := json.Unmarshal(content, out); err != nil {
+		return nil, fmt.Errorf("failed to parse: %s", err)
+	}
+
+	// Check 'version' first, since it could modify the parsing after.
+	if _, ok := raw["version"]; !ok {
+		out.Version = "1.0"
+	}
+	version, err := parseVersion(out.Version)
+	if err != nil {
+		return nil, err
+	}
+	expected, _ := parseVersion(ISOLATED_FILE_VERSION)
+	if version[0] != expected[0] {
+		return nil, fmt.Errorf("expected compatible '%s' version, got '%s'", ISOLATED_FILE_VERSION, out.Version)
+	}
+	if _, ok := raw["algo"]; !ok {
+		out.Algo = "sha-1"
+	}
+	if algo == "" {
+		algo = out.Algo
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch key {
+		case "algo":
+			if _, ok := SUPPORTED_ALGOS[out.Algo]; !ok {
+				return nil, fmt.Errorf("expected one of '%s', got '%s'", strings.Join(supportedAlgos(), ", "), out.Algo)
+			}
+			if out.Algo != algo {
+				return nil, fmt.Errorf("expected '%s', got '%s'", algo, out.Algo)
+			}
+		case "command":
+			if len(out.Command) == 0 {
+				return nil, errors.New("expected non-empty command")
+			}
+		case "files":
+			rawFiles := map[string]map[string]json.RawMessage{}
+			if err := json.Unmarshal(raw[key], &rawFiles); err != nil {
+				return nil, fmt.Errorf("failed to parse: %s", err)
+			}
+			for name, f := range rawFiles {
+				for k := range f {
+					if !strings.Contains("hlmst", k) || len(k) != 1 {
+						return nil, fmt.Errorf("invalid entry %q: unknown key '%s'", name, k)
+					}
+				}
+			}
+			for name, f := range out.Files {
+				if err := f.verify(algo); err != nil {
+					return nil, fmt.Errorf("invalid entry %q: %s", name, err)
+				}
+			}
+		case "includes":
+			if len(out.Includes) == 0 {
+				return nil, errors.New("expected non-empty includes list")
+			}
+			for _, h := range out.Includes {
+				if !IsValidHash(string(h), algo) {
+					return nil, fmt.Errorf("expected %s, got '%s'", algo, h)
+				}
+			}
+		case "os":
+			if version[0] > 1 || (version[0] == 1 && version[1] >= 4) {
+				return nil, errors.New("key 'os' is not allowed starting version 1.4")
+			}
+		case "read_only":
+			if out.ReadOnly == nil || *out.ReadOnly < 0 || *out.ReadOnly > 2 {
+				return nil, fmt.Errorf("expected 0, 1 or 2, got %s", raw[key])
+			}
+		case "relative_cwd", "version":
+		default:
+			return nil, fmt.Errorf("unknown key '%s'", key)
+		}
+	}
+
+	// Automatically fix the path separator if necessary. While .isolated files
+	// are always in the native path format, someone could want to download an
+	// .isolated tree from another OS.
+	if len(out.Files) != 0 {
+		files := make(map[string]IsolatedFile, len(out.Files))
+		for name, f := range out.Files {
+			if f.Link != nil {
+				l := fixPathSeparator(*f.Link)
+				f.Link = &l
+			}
+			files[fixPathSeparator(name)] = f
+		}
+		out.Files = files
+	}
+	out.RelativeCwd = fixPathSeparator(out.RelativeCwd)
+	return out, nil
+}
+
+// LoadIsolatedTree loads an .isolated file and merges the .isolated files it
+// includes, recursively, so that the result has no includes.
+//
+// fetch returns the content of an included .isolated file. The .isolated files
+// are processed in depth-first order and the first value found wins, for each
+// entry in 'files' and for 'command', 'read_only' and 'relative_cwd'.
+func LoadIsolatedTree(content []byte, algo string, fetch func(IsolateHash) ([]byte, error)) (*Isolated, error) {
+	root, err := LoadIsolated(content, algo)
+	if err != nil {
+		return nil, err
+	}
+	out := NewIsolated(root.Algo)
+	out.Version = root.Version
+	seen := map[IsolateHash]bool{}
+	var merge func(i *Isolated) error
+	merge = func(i *Isolated) error {
+		if len(out.Command) == 0 {
+			out.Command = i.Command
+		}
+		if out.ReadOnly == nil {
+			out.ReadOnly = i.ReadOnly
+		}
+		if out.RelativeCwd == "" {
+			out.RelativeCwd = i.RelativeCwd
+		}
+		for f, entry := range i.Files {
+			if _, ok := out.Files[f]; !ok {
+				out.Files[f] = entry
+			}
+		}
+		for _, h := range i.Includes {
+			if seen[h] {
+				return fmt.Errorf("%s is included recursively", h)
+			}
+			seen[h] = true
+			data, err := fetch(h)
+			if err != nil {
+				return fmt.Errorf("failed to fetch %s: %s", h, err)
+			}
+			child, err := LoadIsolated(data, root.Algo)
+			if err != nil {
+				return fmt.Errorf("invalid .isolated file %s: %s", h, err)
+			}
+			if err := merge(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := merge(root); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *IsolatedFile) verify(algo string) error {
+	if f.Digest != "" && !IsValidHash(f.Digest, algo) {
+		return fmt.Errorf("expected %s, got '%s'", algo, f.Digest)
+	}
+	if f.Type != "" {
+		found := false
+		for _, t := range SUPPORTED_FILE_TYPES {
+			found = found || t == f.Type
+		}
+		if !found {
+			return fmt.Errorf("expected one of '%s', got '%s'", strings.Join(SUPPORTED_FILE_TYPES, ", "), f.Type)
+		}
+	}
+	hasDigest, hasLink, hasSize := f.Digest != "", f.Link != nil, f.Size != nil
+	if hasDigest == hasLink {
+		return errors.New("need only one of 'h' (digest) or 'l' (link)")
+	}
+	if hasDigest != hasSize {
+		return errors.New("both 'h' (digest) and 's' (size) should be set")
+	}
+	if hasLink && f.Mode != nil {
+		return errors.New("cannot use 'm' (mode) and 'l' (link)")
+	}
+	return nil
+}
+
+// parseVersion parses a version like "1.4" into its numeric components.
+func parseVersion(v string) ([]int, error) {
+	out := []int{}
+	for _, part := range strings.Split(v, ".") {
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("expected valid version, got '%s'", v)
+		}
+		out = append(out, i)
+	}
+	for len(out) < 2 {
+		out = append(out, 0)
+	}
+	return out, nil
+}
+
+func fixPathSeparator(p string) string {
+	if os.PathSeparator == '/' {
+		return strings.Replace(p, "\\", "/", -1)
+	}
+	return strings.Replace(p, "/", "\\", -1)
+}
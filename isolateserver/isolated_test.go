@@ -0,0 +1,181 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "chromium.googlesource.com/infra/swarming/client-go/internal/types"
+)
+
+// pythonIsolated is the output of the Python client for the same content as
+// newTestIsolated().
+const pythonIsolated = `{"algo":"sha-1","command":["python","\u00fcber.py","<&>","\ud83d\ude00"],` +
+	`"files":{"a/b":{"h":"0123456789abcdef0123456789abcdef01234567","m":416,"s":3},` +
+	`"a/empty":{"h":"da39a3ee5e6b4b0d3255bfef95601890afd80709","s":0},"l":{"l":"a/b"}},` +
+	`"read_only":1,"relative_cwd":"a","version":"1.4"}`
+
+func newTestIsolated() *Isolated {
+	mode := 0640
+	size := int64(3)
+	empty := int64(0)
+	link := "a/b"
+	readOnly := 1
+	i := NewIsolated("sha-1")
+	i.Command = []string{"python", "über.py", "<&>", "\U0001f600"}
+	i.Files["a/b"] = IsolatedFile{Digest: "0123456789abcdef0123456789abcdef01234567", Mode: &mode, Size: &size}
+	i.Files["a/empty"] = IsolatedFile{Digest: "da39a3ee5e6b4b0d3255bfef95601890afd80709", Size: &empty}
+	i.Files["l"] = IsolatedFile{Link: &link}
+	i.ReadOnly = &readOnly
+	i.RelativeCwd = "a"
+	return i
+}
+
+func TestIsolatedMarshal(t *testing.T) {
+	data, err := newTestIsolated().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != pythonIsolated {
+		t.Errorf("expected\n%s\ngot\n%s", pythonIsolated, data)
+	}
+
+	// 'files' is always present.
+	data, err = (&Isolated{Algo: "sha-1", Version: ISOLATED_FILE_VERSION}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"algo":"sha-1","files":{},"version":"1.4"}`; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestLoadIsolated(t *testing.T) {
+	i, err := LoadIsolated([]byte(pythonIsolated), "sha-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := newTestIsolated(); !reflect.DeepEqual(expected, i) {
+		t.Errorf("expected %#v, got %#v", expected, i)
+	}
+
+	// Defaults.
+	i, err = LoadIsolated([]byte(`{"includes":["0123456789abcdef0123456789abcdef01234567"]}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Algo != "sha-1" || i.Version != "1.0" || !reflect.DeepEqual([]IsolateHash{"0123456789abcdef0123456789abcdef01234567"}, i.Includes) {
+		t.Errorf("unexpected %#v", i)
+	}
+	if _, err := LoadIsolated([]byte(`{"os":"linux","version":"1.3"}`), ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadIsolatedInvalid(t *testing.T) {
+	h := "0123456789abcdef0123456789abcdef01234567"
+	data := []struct {
+		content  string
+		algo     string
+		expected string
+	}{
+		{`[]`, "", "failed to parse"},
+		{`{"version":"2.0"}`, "", "expected compatible '1.4' version"},
+		{`{"version":"a"}`, "", "expected valid version"},
+		{`{"algo":"md4"}`, "", "expected one of 'sha-1, sha-256, sha-512', got 'md4'"},
+		{`{"algo":"sha-1"}`, "sha-512", "expected 'sha-512', got 'sha-1'"},
+		{`{"command":[]}`, "", "expected non-empty command"},
+		{`{"command":[1]}`, "", "failed to parse"},
+		{`{"includes":[]}`, "", "expected non-empty includes list"},
+		{`{"includes":["abc"]}`, "", "expected sha-1, got 'abc'"},
+		{`{"os":"linux","version":"1.4"}`, "", "key 'os' is not allowed"},
+		{`{"read_only":3}`, "", "expected 0, 1 or 2, got 3"},
+		{`{"foo":3}`, "", "unknown key 'foo'"},
+		{`{"files":{"a":{"h":"` + h + `"}}}`, "", "both 'h' (digest) and 's' (size) should be set"},
+		{`{"files":{"a":{"h":"` + h + `","s":1,"l":"b"}}}`, "", "need only one of 'h' (digest) or 'l' (link)"},
+		{`{"files":{"a":{"l":"b","m":420}}}`, "", "cannot use 'm' (mode) and 'l' (link)"},
+		{`{"files":{"a":{"h":"A123456789abcdef0123456789abcdef01234567","s":1}}}`, "", "expected sha-1"},
+		{`{"files":{"a":{"h":"` + h + `","s":1,"t":"zip"}}}`, "", "expected one of 'basic, ar, tar', got 'zip'"},
+		{`{"files":{"a":{"h":"` + h + `","s":1,"x":1}}}`, "", "unknown key 'x'"},
+	}
+	for _, line := range data {
+		_, err := LoadIsolated([]byte(line.content), line.algo)
+		if err == nil || !strings.Contains(err.Error(), line.expected) {
+			t.Errorf("%s: expected error %q, got %v", line.content, line.expected, err)
+		}
+	}
+}
+
+func TestLoadIsolatedMixedAlgorithms(t *testing.T) {
+	sha1 := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+	content := `{"algo":"sha-256","files":{"a":{"h":"` + sha1 + `","s":3}}}`
+	if _, err := LoadIsolated([]byte(content), ""); err == nil || !strings.Contains(err.Error(), "expected sha-256") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// An included .isolated file must use the same algorithm.
+	fetch := func(IsolateHash) ([]byte, error) {
+		return []byte(`{"algo":"sha-1"}`), nil
+	}
+	root := `{"algo":"sha-256","includes":["2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"]}`
+	if _, err := LoadIsolatedTree([]byte(root), "", fetch); err == nil || !strings.Contains(err.Error(), "expected 'sha-256', got 'sha-1'") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLoadIsolatedTree(t *testing.T) {
+	h := func(c byte) IsolateHash {
+		return IsolateHash(strings.Repeat(string(c), 40))
+	}
+	contents := map[IsolateHash]string{
+		h('1'): `{"includes":["` + string(h('3')) + `"],"files":{"a":{"l":"child1"},"b":{"l":"child1"}}}`,
+		h('2'): `{"command":["child2"],"read_only":2,"files":{"c":{"l":"child2"}}}`,
+		h('3'): `{"relative_cwd":"child3","files":{"b":{"l":"child3"},"d":{"l":"child3"}}}`,
+	}
+	fetch := func(hash IsolateHash) ([]byte, error) {
+		if c, ok := contents[hash]; ok {
+			return []byte(c), nil
+		}
+		return nil, errors.New("not found")
+	}
+	root := `{"algo":"sha-1","includes":["` + string(h('1')) + `","` + string(h('2')) + `"],` +
+		`"files":{"a":{"l":"root"}},"version":"1.4"}`
+	i, err := LoadIsolatedTree([]byte(root), "sha-1", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{}
+	for f, entry := range i.Files {
+		links[f] = *entry.Link
+	}
+	expected := map[string]string{"a": "root", "b": "child1", "c": "child2", "d": "child3"}
+	if !reflect.DeepEqual(expected, links) {
+		t.Errorf("expected %v, got %v", expected, links)
+	}
+	if !reflect.DeepEqual([]string{"child2"}, i.Command) || *i.ReadOnly != 2 || i.RelativeCwd != "child3" || i.Includes != nil {
+		t.Errorf("unexpected %#v", i)
+	}
+
+	// Errors.
+	contents[h('4')] = `{"includes":["` + string(h('4')) + `"]}`
+	contents[h('5')] = `{"foo":1}`
+	data := []struct {
+		include  IsolateHash
+		expected string
+	}{
+		{h('4'), "is included recursively"},
+		{h('5'), "unknown key 'foo'"},
+		{h('6'), "not found"},
+	}
+	for _, line := range data {
+		root := `{"includes":["` + string(line.include) + `"]}`
+		if _, err := LoadIsolatedTree([]byte(root), "", fetch); err == nil || !strings.Contains(err.Error(), line.expected) {
+			t.Errorf("%s: expected error %q, got %v", line.include, line.expected, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LocalStorageApi is a StorageApi implementation that stores the items in a
+// local directory, e.g. for offline use or to share a store over NFS.
+//
+// Items are stored as <root>/<namespace>/<first 2 chars of digest>/<digest>.
+type LocalStorageApi struct {
+	root, namespace string
+}
+
+// NewLocalStorageApi returns a StorageApi for the namespace in the directory
+// root.
+func NewLocalStorageApi(root, namespace string) *LocalStorageApi {
+	return &LocalStorageApi{filepath.Clean(root), namespace}
+}
+
+// LocalStoreURL returns the file:// URL of the local store in dir.
+func LocalStoreURL(dir string) string {
+	p := filepath.ToSlash(dir)
+	if !strings.HasPrefix(p, "/") {
+		// Windows path, e.g. C:/foo.
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
+
+// localStorePath returns the directory of a file:// URL.
+func localStorePath(serverUrl string) (string, bool) {
+	if !strings.HasPrefix(serverUrl, "file://") {
+		return "", false
+	}
+	u, err := url.Parse(serverUrl)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" {
+		p = strings.TrimPrefix(p, "/")
+	}
+	return filepath.FromSlash(p), true
+}
+
+func (l *LocalStorageApi) Location() string {
+	return LocalStoreURL(l.root)
+}
+
+func (l *LocalStorageApi) Namespace() string {
+	return l.namespace
+}
+
+func (l *LocalStorageApi) GetFetchUrl(digest string) (string, error) {
+	p, err := l.itemPath(digest)
+	if err != nil {
+		return "", err
+	}
+	return LocalStoreURL(p), nil
+}
+
+// itemPath returns the path of the file holding the item digest.
+func (l *LocalStorageApi) itemPath(digest string) (string, error) {
+	// The digest is used as a path, make sure it doesn't escape the store.
+	if !IsValidHash(digest, GetHashAlgo(l.namespace)) {
+		return "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+	return filepath.Join(l.root, l.namespace, digest[:2], digest), nil
+}
+
+func (l *LocalStorageApi) Fetch(done <-chan struct{}, digest string, offset int64) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		if err := l.fetch(done, digest, offset, chOut); err != nil {
+			chError <- err
+		}
+	}()
+	return chOut, chError
+}
+
+func (l *LocalStorageApi) fetch(done <-chan struct{}, digest string, offset int64, chOut chan<- []byte) error {
+	p, err := l.itemPath(digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, 0); err != nil {
+		return err
+	}
+	return sendChunks(done, f, chOut)
+}
+
+// Push writes the content of item to a temporary file and then renames it,
+// so concurrent readers never see a partial item.
+func (l *LocalStorageApi) Push(done <-chan struct{}, item UploadItem, pushState PushState) <-chan error {
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chError)
+		if err := l.push(done, item, pushState); err != nil {
+			chError <- fmt.Errorf("failed to push %s: %s", item.GetDigest(), err)
+		}
+	}()
+	return chError
+}
+
+func (l *LocalStorageApi) push(done <-chan struct{}, item UploadItem, pushState PushState) error {
+	if pushState.UploadUrl == "" {
+		return errors.New("the item must go through Contains first")
+	}
+	p, err := l.itemPath(item.GetDigest())
+	if err != nil {
+		return err
+	}
+	chContent, chContentError := item.GetContent(done)
+	r, w := io.Pipe()
+	go func() {
+		for chunk := range chContent {
+			if _, err := w.Write(chunk); err != nil {
+				break
+			}
+		}
+		// Drain the content in case the write failed.
+		for range chContent {
+		}
+		w.CloseWithError(<-chContentError)
+	}()
+	err = writeItem(p, item.GetDigest(), l.namespace, r)
+	// Unblock the writer if the content was not read entirely.
+	r.Close()
+	return err
+}
+
+// writeItem writes the content of the item digest, as stored in namespace, to
+// p. The content is written to a temporary file which is renamed once the
+// digest is verified, so concurrent readers never see a partial or corrupted
+// item.
+func writeItem(p, digest, namespace string, r io.Reader) error {
+	d, err := newDigestWriter(namespace)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTempFile(filepath.Dir(p), io.TeeReader(r, d))
+	actual, digestErr := d.Digest()
+	if err != nil {
+		return err
+	}
+	if digestErr == nil && actual != digest {
+		digestErr = fmt.Errorf("digest mismatch for %s: got %s", digest, actual)
+	}
+	if digestErr == nil {
+		digestErr = os.Rename(tmp, p)
+	}
+	if digestErr != nil {
+		os.Remove(tmp)
+	}
+	return digestErr
+}
+
+// writeTempFile writes the content of r to a new temporary file in dir and
+// returns its path. The file is readable by everyone, so the store can be
+// shared.
+func writeTempFile(dir string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Contains returns the items without a file in the store.
+func (l *LocalStorageApi) Contains(done <-chan struct{}, items []UploadItem) (map[UploadItem]PushState, error) {
+	missing := map[UploadItem]PushState{}
+	for _, item := range items {
+		p, err := l.itemPath(item.GetDigest())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			missing[item] = PushState{UploadUrl: LocalStoreURL(p)}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
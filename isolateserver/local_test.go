@@ -0,0 +1,117 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorageApi(t *testing.T) {
+	root, err := ioutil.TempDir("", "isolateserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	api := GetStorageApi(LocalStoreURL(root), "default")
+	if api.Location() != "file://"+filepath.ToSlash(root) || api.Namespace() != "default" {
+		t.Errorf("unexpected location %s and namespace %s", api.Location(), api.Namespace())
+	}
+	item := newTestItem(strings.Repeat("local", 10000))
+	missing, err := api.Contains(nil, []UploadItem{item})
+	if err != nil || len(missing) != 1 {
+		t.Fatalf("expected the item to be missing, got %v, %v", missing, err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	if err := <-api.Push(done, item, missing[item]); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(root, "default", item.Digest[:2], item.Digest)
+	if content, err := ioutil.ReadFile(p); err != nil || string(content) != string(item.content) {
+		t.Errorf("unexpected content in %s, %v", p, err)
+	}
+	// The store can be shared with other users.
+	if fi, err := os.Stat(p); err != nil || fi.Mode() != 0644 {
+		t.Errorf("expected mode 0644, got %v, %v", fi.Mode(), err)
+	}
+	if u, _ := api.GetFetchUrl(item.Digest); u != LocalStoreURL(p) {
+		t.Errorf("unexpected fetch url %s", u)
+	}
+	if missing, err = api.Contains(nil, []UploadItem{item}); err != nil || len(missing) != 0 {
+		t.Errorf("expected the item to be present, got %v, %v", missing, err)
+	}
+	if out, err := fetchAll(api, item.Digest, 5); err != nil || out != string(item.content[5:]) {
+		t.Errorf("unexpected fetched content %d bytes, %v", len(out), err)
+	}
+
+	absent := "0000000000000000000000000000000000000000"
+	if _, err := fetchAll(api, absent, 0); err == nil || isTransient(err) {
+		t.Errorf("expected a permanent error for a missing item, got %v", err)
+	}
+	if _, err := fetchAll(api, "../../etc/passwd", 0); err == nil || !strings.Contains(err.Error(), "invalid digest") {
+		t.Errorf("expected an invalid digest error, got %v", err)
+	}
+	if err := <-api.Push(done, item, PushState{}); err == nil {
+		t.Error("expected an error without push state")
+	}
+
+	// An item whose content doesn't match its digest is not stored.
+	bad := newTestItem("bad")
+	bad.content = []byte("other")
+	if missing, err = api.Contains(nil, []UploadItem{bad}); err != nil || len(missing) != 1 {
+		t.Fatalf("expected the item to be missing, got %v, %v", missing, err)
+	}
+	if err := <-api.Push(done, bad, missing[bad]); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	if missing, err = api.Contains(nil, []UploadItem{bad}); err != nil || len(missing) != 1 {
+		t.Errorf("expected the item to still be missing, got %v, %v", missing, err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(root, "default", bad.Digest[:2])); len(entries) != 0 {
+		t.Errorf("expected no file left behind, got %d", len(entries))
+	}
+
+	// For namespaces with compression, the digest is of the uncompressed
+	// content.
+	gzipApi := NewLocalStorageApi(root, "default-gzip")
+	if err := <-gzipApi.Push(done, item, PushState{UploadUrl: "x"}); err == nil || !strings.Contains(err.Error(), "zlib") {
+		t.Errorf("expected an error for uncompressed content, got %v", err)
+	}
+}
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	root, err := ioutil.TempDir("", "isolateserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, namespace := range []string{"default", "default-gzip"} {
+		s := NewStorage(LocalStoreURL(root), namespace)
+		item := newTestItem(strings.Repeat("round trip ", 1000))
+		for _, expected := range []int{1, 0} {
+			chItems := make(chan UploadItem, 1)
+			chItems <- item
+			close(chItems)
+			stats, err := s.Upload(nil, chItems)
+			if err != nil || stats.ItemsCold != expected {
+				t.Fatalf("%s: expected %d item uploaded, got %s, %v", namespace, expected, stats, err)
+			}
+		}
+		chOut, chError := s.Fetch(nil, item.Digest)
+		out := ""
+		for chunk := range chOut {
+			out += string(chunk)
+		}
+		if err := <-chError; err != nil || out != string(item.content) {
+			t.Errorf("%s: unexpected fetched content %d bytes, %v", namespace, len(out), err)
+		}
+	}
+}
@@ -4,7 +4,17 @@
 
 package isolateserver
 
-import "errors"
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
 
 // ISOLATE_PROTOCOL_VERSION is passed to the serverUrl in /handshake request.
 const ISOLATE_PROTOCOL_VERSION = "1.0"
@@ -16,6 +26,26 @@ var ALREADY_COMPRESSED_TYPES = []string{
 	"png", "wav", "zip",
 }
 
+// DISK_FILE_CHUNK is the chunk size to use when reading from a file.
+const DISK_FILE_CHUNK = 1024 * 1024
+
+// FETCH_MAX_ATTEMPTS is the number of times in a row Storage.Fetch tries to
+// fetch an item without receiving any new data before giving up.
+const FETCH_MAX_ATTEMPTS = 5
+
+// fetchRetryDelay is multiplied by the number of failures to wait before
+// resuming a fetch.
+var fetchRetryDelay = time.Second
+
+// ITEMS_PER_CONTAINS_QUERIES is the number of items sent in each Contains
+// call by Storage.Upload. The first calls are small so the uploads can start
+// early, the last value is used for all the remaining calls.
+var ITEMS_PER_CONTAINS_QUERIES = []int{16, 256, 1000}
+
+// MAX_CONCURRENT_PUSHES is the number of items pushed concurrently by
+// Storage.Upload.
+const MAX_CONCURRENT_PUSHES = 16
+
 type UploadItem interface {
 	GetDigest() string
 	GetSize() int64
@@ -54,25 +84,105 @@ func (i *Item) GetContent(done <-chan struct{}) (<-chan []byte, <-chan error) {
 	return nil, chError
 }
 
+// FileItem is an UploadItem whose content is read from a file.
 type FileItem struct {
 	Item
 	Path string
 }
 
+// GetContent streams the content of the file in chunks of DISK_FILE_CHUNK.
+//
+// It is an error if the file size is not Size, since it means the file was
+// modified after it was hashed.
 func (f *FileItem) GetContent(done <-chan struct{}) (<-chan []byte, <-chan error) {
 	chOut := make(chan []byte)
 	chError := make(chan error, 1)
 	go func() {
 		defer close(chOut)
 		defer close(chError)
-		// TODO(tandrii): read file
-		chError <- errors.New("GetContent Not implemented")
+		if err := f.readFile(done, chOut); err != nil {
+			chError <- err
+		}
 	}()
 	return chOut, chError
 }
 
+func (f *FileItem) readFile(done <-chan struct{}, chOut chan<- []byte) error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var size int64
+	for {
+		buf := make([]byte, DISK_FILE_CHUNK)
+		n, err := io.ReadFull(file, buf)
+		size += int64(n)
+		if size > f.Size {
+			return fmt.Errorf("%s changed after it was hashed: it is larger than %d bytes", f.Path, f.Size)
+		}
+		if n != 0 {
+			select {
+			case chOut <- buf[:n]:
+			case <-done:
+				return errors.New("canceled")
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", f.Path, err)
+		}
+	}
+	if size != f.Size {
+		return fmt.Errorf("%s changed after it was hashed: it is %d bytes instead of %d", f.Path, size, f.Size)
+	}
+	return nil
+}
+
+// BufferItem is an UploadItem whose content is in memory, e.g. a generated
+// .isolated file.
+type BufferItem struct {
+	Item
+	Buffer []byte
+}
+
+// NewBufferItem returns a BufferItem for buffer hashed with algo.
+func NewBufferItem(buffer []byte, algo string, highPriority bool) (*BufferItem, error) {
+	digest, err := HashBytes(buffer, algo)
+	if err != nil {
+		return nil, err
+	}
+	return &BufferItem{
+		Item: Item{
+			Digest:           digest,
+			Size:             int64(len(buffer)),
+			HighPriority:     highPriority,
+			CompressionLevel: 6,
+		},
+		Buffer: buffer,
+	}, nil
+}
+
+// GetContent sends the buffer as a single chunk.
+func (b *BufferItem) GetContent(done <-chan struct{}) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte, 1)
+	chError := make(chan error)
+	chOut <- b.Buffer
+	close(chOut)
+	close(chError)
+	return chOut, chError
+}
+
+// PushState is the upload ticket returned by the server for an item missing
+// on the server, see StorageApi.Contains.
 type PushState struct {
-	// TODO
+	// UploadUrl is where to PUT the content of the item.
+	UploadUrl string
+	// FinalizeUrl, if set, must be POSTed to once the content is uploaded. It is
+	// only used for large items; small ones are stored inline in one request.
+	FinalizeUrl string
 }
 
 // StorageApi is an interface for classes that implement low-level storage operations.
@@ -124,24 +234,70 @@ type StorageApi interface {
 	// Checks for items on the server, prepares missing ones for upload.
 	//
 	// Arguments:
+	//   done: closing it cancels the call.
 	//   items: list of UploadItem objects to check for presence.
 	//
 	// Returns:
 	//   A dict missing Item -> opaque push state object to be passed to 'push'.
 	//   See doc string for 'push'.
-	Contains(items []UploadItem) map[UploadItem]PushState
+	Contains(done <-chan struct{}, items []UploadItem) (map[UploadItem]PushState, error)
 }
 
+// GetStorageApi returns the StorageApi for the namespace on the Isolate server
+// at serverUrl, or in the local directory of a file:// serverUrl.
 func GetStorageApi(serverUrl, namespace string) StorageApi {
-	// TODO(tandrii): add real API next.
-	d := DryLoggingStorageApi{serverUrl, namespace, make([][]interface{}, 0)}
-	return &d
+	if root, ok := localStorePath(serverUrl); ok {
+		return NewLocalStorageApi(root, namespace)
+	}
+	return NewIsolateServer(serverUrl, namespace)
 }
 
-// DryLoggingStorageApi doesn't actually do anything but logs every api call.
+// DryLoggingStorageApi is a StorageApi that doesn't talk to any server, e.g.
+// for -dry-run. It records every call, reports all the items as missing and
+// drains the content of the pushed items to count their size.
 type DryLoggingStorageApi struct {
 	serverUrl, namespace string
-	events               [][]interface{}
+
+	lock sync.Mutex
+	// events are the calls with their arguments, e.g. {"Push", digest, size}.
+	events [][]interface{}
+	pushes []DryPush
+}
+
+// DryPush describes an item pushed to a DryLoggingStorageApi.
+type DryPush struct {
+	Digest string
+	// Path is the file of the item, if any.
+	Path string
+	// Size is the size of the item and Sent the number of bytes that would be
+	// sent, which are less when the namespace uses compression.
+	Size, Sent int64
+}
+
+// NewDryLoggingStorageApi returns a DryLoggingStorageApi pretending to be the
+// namespace on the Isolate server at serverUrl.
+func NewDryLoggingStorageApi(serverUrl, namespace string) *DryLoggingStorageApi {
+	return &DryLoggingStorageApi{serverUrl: serverUrl, namespace: namespace}
+}
+
+// Events returns the calls made so far with their arguments.
+func (a *DryLoggingStorageApi) Events() [][]interface{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([][]interface{}{}, a.events...)
+}
+
+// Pushes returns the items pushed so far, in the order they completed.
+func (a *DryLoggingStorageApi) Pushes() []DryPush {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]DryPush{}, a.pushes...)
+}
+
+func (a *DryLoggingStorageApi) record(event ...interface{}) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.events = append(a.events, event)
 }
 
 func (a *DryLoggingStorageApi) Location() string {
@@ -150,40 +306,434 @@ func (a *DryLoggingStorageApi) Location() string {
 func (a *DryLoggingStorageApi) Namespace() string {
 	return a.namespace
 }
-func (a *DryLoggingStorageApi) GetFetchUrl(string) (string, error) {
+func (a *DryLoggingStorageApi) GetFetchUrl(digest string) (string, error) {
+	a.record("GetFetchUrl", digest)
 	return "", errors.New("not implemented for DryLoggingStorageApi")
 }
 
-func (a *DryLoggingStorageApi) Fetch(<-chan struct{}, string, int64) (<-chan []byte, <-chan error) {
-	return nil, nil
+func (a *DryLoggingStorageApi) Fetch(done <-chan struct{}, digest string, offset int64) (<-chan []byte, <-chan error) {
+	a.record("Fetch", digest, offset)
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	close(chOut)
+	chError <- &HTTPError{StatusCode: 404, msg: "not implemented for DryLoggingStorageApi"}
+	close(chError)
+	return chOut, chError
 }
 
+// Push reads the content of item and discards it.
 func (a *DryLoggingStorageApi) Push(done <-chan struct{}, item UploadItem, pushState PushState) <-chan error {
-	return nil
+	a.record("Push", item.GetDigest(), item.GetSize())
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chError)
+		push := DryPush{Digest: item.GetDigest(), Path: uploadItemPath(item), Size: item.GetSize()}
+		chContent, chContentError := item.GetContent(done)
+		for chunk := range chContent {
+			push.Sent += int64(len(chunk))
+		}
+		if err := <-chContentError; err != nil {
+			chError <- fmt.Errorf("failed to push %s: %s", item.GetDigest(), err)
+			return
+		}
+		a.lock.Lock()
+		a.pushes = append(a.pushes, push)
+		a.lock.Unlock()
+	}()
+	return chError
 }
 
-func (a *DryLoggingStorageApi) Contains(items []UploadItem) map[UploadItem]PushState {
-	return nil
+// Contains reports all the items as missing.
+func (a *DryLoggingStorageApi) Contains(done <-chan struct{}, items []UploadItem) (map[UploadItem]PushState, error) {
+	digests := make([]string, len(items))
+	missing := map[UploadItem]PushState{}
+	for i, item := range items {
+		digests[i] = item.GetDigest()
+		missing[item] = PushState{}
+	}
+	a.record("Contains", digests)
+	return missing, nil
+}
+
+// uploadItemPath returns the path of the file of item, or "" if item is not a
+// file.
+func uploadItemPath(item UploadItem) string {
+	switch i := item.(type) {
+	case *compressedItem:
+		return uploadItemPath(i.UploadItem)
+	case *FileItem:
+		return i.Path
+	}
+	return ""
 }
 
 type Storage struct {
 	api StorageApi
-	// TODO(tandrii): maybe add hashalgo support for namespaces.
+	// algo is the hashing algorithm used by the namespace.
+	algo           string
 	useCompression bool
+	// pushers is the number of concurrent pushes.
+	pushers int
+}
+
+// UploadStats are the statistics of a Storage.Upload call.
+type UploadStats struct {
+	// Items already present on the server.
+	ItemsHot int
+	SizeHot  int64
+	// Items pushed to the server.
+	ItemsCold int
+	SizeCold  int64
+	// Number of Contains calls.
+	Contains int
+}
+
+func (u UploadStats) String() string {
+	return fmt.Sprintf("%d items (%d bytes) hot, %d items (%d bytes) cold, %d lookups",
+		u.ItemsHot, u.SizeHot, u.ItemsCold, u.SizeCold, u.Contains)
 }
 
 func NewStorage(serverUrl, namespace string) Storage {
+	return NewStorageWithApi(GetStorageApi(serverUrl, namespace))
+}
+
+// NewStorageWithApi returns a Storage using api, e.g. a DryLoggingStorageApi.
+func NewStorageWithApi(api StorageApi) Storage {
 	return Storage{
-		GetStorageApi(serverUrl, namespace),
-		false, //TODO
+		api,
+		GetHashAlgo(api.Namespace()),
+		IsNamespaceWithCompression(api.Namespace()),
+		MAX_CONCURRENT_PUSHES,
 	}
 }
 
+// HashAlgo returns the hashing algorithm used by the namespace.
+func (s *Storage) HashAlgo() string {
+	return s.algo
+}
+
 func (s *Storage) Connect() error {
 	return nil
 }
 
-func (s *Storage) Upload(chItems <-chan UploadItem) error {
-	// TODO
-	return nil
+// Fetch returns the content of digest, decompressed if the namespace uses
+// compression.
+//
+// When the connection drops, the fetch is resumed from the last byte
+// received, up to FETCH_MAX_ATTEMPTS times in a row without progress. The
+// digest of the content is verified once it is all received: the chunks must
+// not be used until the error channel returns nil.
+func (s *Storage) Fetch(done <-chan struct{}, digest string) (<-chan []byte, <-chan error) {
+	if !IsValidHash(digest, s.algo) {
+		chOut := make(chan []byte)
+		chError := make(chan error, 1)
+		close(chOut)
+		chError <- fmt.Errorf("invalid %s digest '%s'", s.algo, digest)
+		close(chError)
+		return chOut, chError
+	}
+	chOut, chError := s.fetchResumable(done, digest)
+	if s.useCompression {
+		chOut, chError = zipDecompress(done, chOut, chError)
+	}
+	return verifyDigest(done, chOut, chError, digest, s.algo)
+}
+
+// fetchResumable fetches the raw content of digest, resuming on transient
+// errors.
+func (s *Storage) fetchResumable(done <-chan struct{}, digest string) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		var offset int64
+		failures := 0
+		for {
+			chIn, chInError := s.api.Fetch(done, digest, offset)
+			progress := false
+			canceled := false
+			for chunk := range chIn {
+				if canceled {
+					// Let the fetch exit.
+					continue
+				}
+				select {
+				case chOut <- chunk:
+					offset += int64(len(chunk))
+					progress = true
+				case <-done:
+					canceled = true
+				}
+			}
+			err := <-chInError
+			if canceled {
+				chError <- errors.New("fetch canceled")
+				return
+			}
+			if err == nil {
+				return
+			}
+			if progress {
+				failures = 0
+			}
+			failures++
+			if !isTransient(err) || failures >= FETCH_MAX_ATTEMPTS {
+				chError <- err
+				return
+			}
+			log.Printf("warning: fetching %s failed at offset %d, retrying: %s", digest, offset, err)
+			select {
+			case <-time.After(time.Duration(failures) * fetchRetryDelay):
+			case <-done:
+				chError <- errors.New("fetch canceled")
+				return
+			}
+		}
+	}()
+	return chOut, chError
+}
+
+// verifyDigest forwards the chunks while hashing them, and returns an error
+// if the digest of the content is not digest.
+func verifyDigest(done <-chan struct{}, chIn <-chan []byte, chInError <-chan error, digest, algo string) (<-chan []byte, <-chan error) {
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		h, err := NewHash(algo)
+		if err != nil {
+			chError <- err
+			return
+		}
+		canceled := false
+		for chunk := range chIn {
+			if canceled {
+				continue
+			}
+			h.Write(chunk)
+			select {
+			case chOut <- chunk:
+			case <-done:
+				canceled = true
+			}
+		}
+		if err := <-chInError; err != nil {
+			chError <- err
+			return
+		}
+		if canceled {
+			chError <- errors.New("fetch canceled")
+			return
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+			chError <- fmt.Errorf("digest mismatch for %s: got %s", digest, actual)
+		}
+	}()
+	return chOut, chError
+}
+
+// Upload uploads the items received on chItems that are missing on the server.
+//
+// Items are looked up with Contains in batches growing as described by
+// ITEMS_PER_CONTAINS_QUERIES, then the missing ones are pushed concurrently.
+// High priority items, i.e. .isolated files, are pushed first. Items with the
+// same digest are only uploaded once. In namespaces with compression, the
+// content is compressed at the item's compression level while it is pushed.
+//
+// Upload stops on the first error or when done is closed; it doesn't read
+// chItems anymore in that case.
+func (s *Storage) Upload(done <-chan struct{}, chItems <-chan UploadItem) (UploadStats, error) {
+	u := uploader{storage: s, stop: make(chan struct{})}
+	// Propagate done to the pushes, until the upload is over.
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			u.fail(errors.New("upload canceled"))
+		case <-finished:
+		}
+	}()
+	defer close(finished)
+
+	chHigh := make(chan pushItem)
+	chNormal := make(chan pushItem)
+	pushers := s.pushers
+	if pushers < 1 {
+		pushers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.pusher(chHigh, chNormal)
+		}()
+	}
+	u.lookup(chItems, chHigh, chNormal)
+	close(chHigh)
+	close(chNormal)
+	wg.Wait()
+	return u.stats, u.err
+}
+
+// pushItem is an item missing on the server.
+type pushItem struct {
+	item      UploadItem
+	pushState PushState
+}
+
+// uploader holds the state of a Storage.Upload call.
+type uploader struct {
+	storage *Storage
+	// stop is closed on the first error, or when the upload is canceled.
+	stop chan struct{}
+
+	lock  sync.Mutex
+	err   error
+	stats UploadStats
+}
+
+func (u *uploader) fail(err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.err == nil {
+		u.err = err
+		close(u.stop)
+	}
+}
+
+// lookup reads the items in batches, looks them up on the server and sends
+// the missing ones to chHigh or chNormal.
+func (u *uploader) lookup(chItems <-chan UploadItem, chHigh, chNormal chan<- pushItem) {
+	seen := map[string]bool{}
+	batch := []UploadItem{}
+	for calls := 0; ; {
+		limit := ITEMS_PER_CONTAINS_QUERIES[len(ITEMS_PER_CONTAINS_QUERIES)-1]
+		if calls < len(ITEMS_PER_CONTAINS_QUERIES) {
+			limit = ITEMS_PER_CONTAINS_QUERIES[calls]
+		}
+		closed := false
+		for len(batch) < limit && !closed {
+			select {
+			case item, ok := <-chItems:
+				if !ok {
+					closed = true
+					break
+				}
+				if !IsValidHash(item.GetDigest(), u.storage.algo) {
+					u.fail(fmt.Errorf("invalid %s digest '%s'", u.storage.algo, item.GetDigest()))
+					return
+				}
+				if !seen[item.GetDigest()] {
+					seen[item.GetDigest()] = true
+					batch = append(batch, item)
+				}
+			case <-u.stop:
+				return
+			}
+		}
+		if len(batch) != 0 {
+			calls++
+			if !u.lookupBatch(batch, chHigh, chNormal) {
+				return
+			}
+			batch = []UploadItem{}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// lookupBatch does a Contains call for batch and sends the missing items, the
+// high priority and largest first. It returns false on error.
+func (u *uploader) lookupBatch(batch []UploadItem, chHigh, chNormal chan<- pushItem) bool {
+	missing, err := u.storage.api.Contains(u.stop, batch)
+	if err != nil {
+		u.fail(err)
+		return false
+	}
+	u.lock.Lock()
+	u.stats.Contains++
+	for _, item := range batch {
+		if _, ok := missing[item]; !ok {
+			u.stats.ItemsHot++
+			u.stats.SizeHot += item.GetSize()
+		}
+	}
+	u.lock.Unlock()
+	sort.Sort(uploadItemsByPriority(batch))
+	for _, item := range batch {
+		pushState, ok := missing[item]
+		if !ok {
+			continue
+		}
+		ch := chNormal
+		if item.IsHighPriority() {
+			ch = chHigh
+		}
+		select {
+		case ch <- pushItem{item, pushState}:
+		case <-u.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// pusher pushes the items received, preferring the high priority ones.
+func (u *uploader) pusher(chHigh, chNormal <-chan pushItem) {
+	for chHigh != nil || chNormal != nil {
+		var p pushItem
+		var ok bool
+		select {
+		case p, ok = <-chHigh:
+			if !ok {
+				chHigh = nil
+				continue
+			}
+		default:
+			select {
+			case p, ok = <-chHigh:
+				if !ok {
+					chHigh = nil
+					continue
+				}
+			case p, ok = <-chNormal:
+				if !ok {
+					chNormal = nil
+					continue
+				}
+			case <-u.stop:
+				return
+			}
+		}
+		item := p.item
+		if u.storage.useCompression {
+			item = &compressedItem{item}
+		}
+		if err := <-u.storage.api.Push(u.stop, item, p.pushState); err != nil {
+			u.fail(err)
+			return
+		}
+		u.lock.Lock()
+		u.stats.ItemsCold++
+		u.stats.SizeCold += p.item.GetSize()
+		u.lock.Unlock()
+	}
+}
+
+// uploadItemsByPriority sorts the high priority items first, then the largest
+// ones first.
+type uploadItemsByPriority []UploadItem
+
+func (u uploadItemsByPriority) Len() int      { return len(u) }
+func (u uploadItemsByPriority) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u uploadItemsByPriority) Less(i, j int) bool {
+	if u[i].IsHighPriority() != u[j].IsHighPriority() {
+		return u[i].IsHighPriority()
+	}
+	return u[i].GetSize() > u[j].GetSize()
 }
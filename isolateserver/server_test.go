@@ -0,0 +1,409 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorageApi records the calls. Items with a digest in present are
+// reported as present on the server.
+type fakeStorageApi struct {
+	DryLoggingStorageApi
+	present map[string]bool
+	// block, if set, makes Push wait for done.
+	block bool
+	// pushErr is returned by Push.
+	pushErr error
+
+	lock     sync.Mutex
+	batches  []int
+	pushed   []string
+	inFlight int
+	maxIO    int
+}
+
+func (f *fakeStorageApi) Contains(done <-chan struct{}, items []UploadItem) (map[UploadItem]PushState, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.batches = append(f.batches, len(items))
+	out := map[UploadItem]PushState{}
+	for _, item := range items {
+		if !f.present[item.GetDigest()] {
+			out[item] = PushState{UploadUrl: item.GetDigest()}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeStorageApi) Push(done <-chan struct{}, item UploadItem, pushState PushState) <-chan error {
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chError)
+		f.lock.Lock()
+		f.inFlight++
+		if f.inFlight > f.maxIO {
+			f.maxIO = f.inFlight
+		}
+		f.pushed = append(f.pushed, pushState.UploadUrl)
+		f.lock.Unlock()
+		if f.block {
+			<-done
+			chError <- errors.New("canceled")
+		} else {
+			// Give a chance to the other pushers to run concurrently.
+			time.Sleep(time.Millisecond)
+			chError <- f.pushErr
+		}
+		f.lock.Lock()
+		f.inFlight--
+		f.lock.Unlock()
+	}()
+	return chError
+}
+
+func genItems(n int, highPriority func(i int) bool) []UploadItem {
+	out := make([]UploadItem, n)
+	for i := range out {
+		digest, _ := HashBytes([]byte(fmt.Sprintf("item %d", i)), "sha-1")
+		out[i] = &Item{Digest: digest, Size: int64(i), HighPriority: highPriority(i)}
+	}
+	return out
+}
+
+func sendItems(items []UploadItem) <-chan UploadItem {
+	ch := make(chan UploadItem, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	return ch
+}
+
+func TestStorageUpload(t *testing.T) {
+	items := genItems(1500, func(i int) bool { return false })
+	api := &fakeStorageApi{present: map[string]bool{}}
+	for _, item := range items[:500] {
+		api.present[item.GetDigest()] = true
+	}
+	s := Storage{api: api, algo: "sha-1", pushers: 4}
+	// Duplicated items are only looked up once.
+	stats, err := s.Upload(make(chan struct{}), sendItems(append(items, items[0], items[600])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizeHot, sizeCold int64
+	for i, item := range items {
+		if i < 500 {
+			sizeHot += item.GetSize()
+		} else {
+			sizeCold += item.GetSize()
+		}
+	}
+	expected := UploadStats{ItemsHot: 500, SizeHot: sizeHot, ItemsCold: 1000, SizeCold: sizeCold, Contains: 4}
+	if stats != expected {
+		t.Errorf("expected %s, got %s", expected, stats)
+	}
+	if fmt.Sprint(api.batches) != "[16 256 1000 228]" {
+		t.Errorf("unexpected batches %v", api.batches)
+	}
+	if api.maxIO < 2 || api.maxIO > 4 {
+		t.Errorf("expected at most 4 concurrent pushes, got %d", api.maxIO)
+	}
+}
+
+func TestStorageUploadPriority(t *testing.T) {
+	items := genItems(16, func(i int) bool { return i%4 == 0 })
+	api := &fakeStorageApi{present: map[string]bool{}}
+	s := Storage{api: api, algo: "sha-1", pushers: 1}
+	if _, err := s.Upload(make(chan struct{}), sendItems(items)); err != nil {
+		t.Fatal(err)
+	}
+	// The high priority items are pushed first, then the largest first.
+	expected := []string{}
+	for _, i := range []int{12, 8, 4, 0, 15, 14, 13, 11, 10, 9, 7, 6, 5, 3, 2, 1} {
+		expected = append(expected, items[i].GetDigest())
+	}
+	if strings.Join(expected, ",") != strings.Join(api.pushed, ",") {
+		t.Errorf("unexpected push order")
+	}
+}
+
+func TestStorageUploadErrors(t *testing.T) {
+	s := Storage{api: &fakeStorageApi{}, algo: "sha-256", pushers: 2}
+	if _, err := s.Upload(make(chan struct{}), sendItems(genItems(1, func(int) bool { return false }))); err == nil || !strings.Contains(err.Error(), "invalid sha-256 digest") {
+		t.Errorf("expected an invalid digest error, got %v", err)
+	}
+
+	s = Storage{api: &fakeStorageApi{pushErr: errors.New("push failed")}, algo: "sha-1", pushers: 2}
+	if _, err := s.Upload(make(chan struct{}), sendItems(genItems(100, func(int) bool { return false }))); err == nil || err.Error() != "push failed" {
+		t.Errorf("expected the push error, got %v", err)
+	}
+}
+
+func TestStorageUploadCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	api := &fakeStorageApi{block: true}
+	s := Storage{api: api, algo: "sha-1", pushers: 4}
+	done := make(chan struct{})
+	// The items channel is never closed.
+	chItems := make(chan UploadItem)
+	go func() {
+		for _, item := range genItems(20, func(int) bool { return false }) {
+			select {
+			case chItems <- item:
+			case <-done:
+				return
+			}
+		}
+	}()
+	chErr := make(chan error)
+	go func() {
+		_, err := s.Upload(done, chItems)
+		chErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	select {
+	case err := <-chErr:
+		if err == nil {
+			t.Error("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload didn't stop")
+	}
+	// All the goroutines must be gone.
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("leaked %d goroutines", n-before)
+	}
+}
+
+func readContent(item UploadItem, done <-chan struct{}) ([]byte, int, error) {
+	chOut, chError := item.GetContent(done)
+	out := []byte{}
+	chunks := 0
+	for chunk := range chOut {
+		out = append(out, chunk...)
+		chunks++
+	}
+	return out, chunks, <-chError
+}
+
+func TestFileItem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolateserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "foo")
+	content := bytes.Repeat([]byte("a"), 2*DISK_FILE_CHUNK+1)
+	if err := ioutil.WriteFile(p, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	item := &FileItem{Item{Size: int64(len(content))}, p}
+	if out, chunks, err := readContent(item, done); err != nil || chunks != 3 || !bytes.Equal(content, out) {
+		t.Errorf("unexpected content in %d chunks, %v", chunks, err)
+	}
+
+	// The file changed after it was hashed.
+	for _, size := range []int64{int64(len(content)) - 1, int64(len(content)) + 1} {
+		item.Size = size
+		if _, _, err := readContent(item, done); err == nil || !strings.Contains(err.Error(), "changed after it was hashed") {
+			t.Errorf("size %d: expected an error, got %v", size, err)
+		}
+	}
+	item.Path = filepath.Join(dir, "missing")
+	if _, _, err := readContent(item, done); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	// Closing done stops the read.
+	item = &FileItem{Item{Size: int64(len(content))}, p}
+	close(done)
+	_, chError := item.GetContent(done)
+	if err := <-chError; err == nil {
+		t.Error("expected an error once done is closed")
+	}
+}
+
+func TestBufferItem(t *testing.T) {
+	item, err := NewBufferItem([]byte("foo"), "sha-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.GetDigest() != "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33" || item.GetSize() != 3 || !item.IsHighPriority() {
+		t.Errorf("unexpected item %#v", item)
+	}
+	if out, _, err := readContent(item, nil); err != nil || string(out) != "foo" {
+		t.Errorf("unexpected content %q, %v", out, err)
+	}
+	if _, err := NewBufferItem([]byte("foo"), "md5", false); err == nil {
+		t.Error("expected an error for an unknown algo")
+	}
+}
+
+// flakyStorageApi serves contents, dropping the connection after dropAfter
+// bytes in each Fetch call.
+type flakyStorageApi struct {
+	DryLoggingStorageApi
+	contents  map[string][]byte
+	dropAfter int64
+
+	lock    sync.Mutex
+	offsets []int64
+}
+
+func (f *flakyStorageApi) Fetch(done <-chan struct{}, digest string, offset int64) (<-chan []byte, <-chan error) {
+	f.lock.Lock()
+	f.offsets = append(f.offsets, offset)
+	f.lock.Unlock()
+	chOut := make(chan []byte)
+	chError := make(chan error, 1)
+	go func() {
+		defer close(chOut)
+		defer close(chError)
+		content, ok := f.contents[digest]
+		if !ok {
+			chError <- &HTTPError{StatusCode: 404, msg: "not found"}
+			return
+		}
+		end := offset + f.dropAfter
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		for i := offset; i < end; i += 1000 {
+			j := i + 1000
+			if j > end {
+				j = end
+			}
+			select {
+			case chOut <- content[i:j]:
+			case <-done:
+				return
+			}
+		}
+		if end != int64(len(content)) {
+			chError <- errors.New("connection reset")
+		}
+	}()
+	return chOut, chError
+}
+
+func TestStorageFetch(t *testing.T) {
+	defer func(d time.Duration) { fetchRetryDelay = d }(fetchRetryDelay)
+	fetchRetryDelay = 0
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	digest, _ := HashBytes(content, "sha-1")
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(content)
+	w.Close()
+	fetch := func(s Storage, digest string) ([]byte, error) {
+		chOut, chError := s.Fetch(make(chan struct{}), digest)
+		out := []byte{}
+		for chunk := range chOut {
+			out = append(out, chunk...)
+		}
+		return out, <-chError
+	}
+
+	// The fetch is resumed where the connection dropped.
+	api := &flakyStorageApi{contents: map[string][]byte{digest: content}, dropAfter: 3000}
+	out, err := fetch(Storage{api: api, algo: "sha-1"}, digest)
+	if err != nil || !bytes.Equal(content, out) {
+		t.Errorf("unexpected content, %v", err)
+	}
+	if fmt.Sprint(api.offsets) != "[0 3000 6000 9000]" {
+		t.Errorf("unexpected offsets %v", api.offsets)
+	}
+
+	// Compressed content is decompressed, the offsets are in the compressed
+	// stream.
+	api = &flakyStorageApi{contents: map[string][]byte{digest: compressed.Bytes()}, dropAfter: 50}
+	out, err = fetch(Storage{api: api, algo: "sha-1", useCompression: true}, digest)
+	if err != nil || !bytes.Equal(content, out) {
+		t.Errorf("unexpected content, %v", err)
+	}
+	if len(api.offsets) != (compressed.Len()+49)/50 {
+		t.Errorf("unexpected offsets %v", api.offsets)
+	}
+
+	// The digest is verified.
+	other, _ := HashBytes([]byte("other"), "sha-1")
+	api = &flakyStorageApi{contents: map[string][]byte{other: content}, dropAfter: 100000}
+	if _, err := fetch(Storage{api: api, algo: "sha-1"}, other); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	if _, err := fetch(Storage{api: api, algo: "sha-256"}, other); err == nil || !strings.Contains(err.Error(), "invalid sha-256 digest") {
+		t.Errorf("expected an invalid digest error, got %v", err)
+	}
+
+	// Permanent errors are not retried.
+	api = &flakyStorageApi{contents: map[string][]byte{}, dropAfter: 100000}
+	if _, err := fetch(Storage{api: api, algo: "sha-1"}, digest); err == nil || len(api.offsets) != 1 {
+		t.Errorf("expected a single attempt, got %v, %v", api.offsets, err)
+	}
+	// The fetch fails when no progress is made.
+	api = &flakyStorageApi{contents: map[string][]byte{digest: content}, dropAfter: 0}
+	if _, err := fetch(Storage{api: api, algo: "sha-1"}, digest); err == nil || len(api.offsets) != FETCH_MAX_ATTEMPTS {
+		t.Errorf("expected %d attempts, got %v, %v", FETCH_MAX_ATTEMPTS, api.offsets, err)
+	}
+}
+
+func TestDryLoggingStorageApi(t *testing.T) {
+	api := NewDryLoggingStorageApi("https://example.com", "default-gzip")
+	s := NewStorageWithApi(api)
+	small := newTestItem("small")
+	large := newTestItem(strings.Repeat("large", 1000))
+	large.CompressionLevel = 6
+	chItems := make(chan UploadItem, 2)
+	chItems <- small
+	chItems <- large
+	close(chItems)
+	stats, err := s.Upload(nil, chItems)
+	if err != nil || stats.ItemsCold != 2 {
+		t.Fatalf("expected 2 items pushed, got %s, %v", stats, err)
+	}
+
+	pushes := api.Pushes()
+	if len(pushes) != 2 {
+		t.Fatalf("expected 2 pushes, got %v", pushes)
+	}
+	for _, p := range pushes {
+		if p.Digest == large.Digest && (p.Size != 5000 || p.Sent == 0 || p.Sent >= p.Size) {
+			t.Errorf("expected the compressed size to be counted, got %+v", p)
+		}
+	}
+	events := api.Events()
+	if len(events) != 3 || events[0][0] != "Contains" || len(events[0][1].([]string)) != 2 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	// The largest item is pushed first.
+	if events[1][0] != "Push" || events[1][1] != large.Digest || events[1][2] != int64(5000) {
+		t.Errorf("unexpected push event %v", events[1])
+	}
+
+	if _, err := fetchAll(api, small.Digest, 0); err == nil || isTransient(err) {
+		t.Errorf("expected a permanent fetch error, got %v", err)
+	}
+	if events = api.Events(); events[len(events)-1][0] != "Fetch" {
+		t.Errorf("expected the fetch to be recorded, got %v", events)
+	}
+}